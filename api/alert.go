@@ -2,54 +2,176 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
 	"github.com/button-tech/utils-rate-alerts/pkg/respond"
 	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/pkg/errors"
 	routing "github.com/qiangxue/fasthttp-routing"
-	"github.com/streadway/amqp"
 	"github.com/valyala/fasthttp"
 )
 
-type alert struct {
-	Currency  string `json:"currency"`
-	Price     string `json:"price"`
-	Fiat      string `json:"fiat"`
-	Condition string `json:"condition"`
-	URL       string `json:"url"`
-}
-
 func (ac *apiController) alert(ctx *routing.Context) error {
 	var (
-		body alert
+		body t.Alert
 		err  error
 	)
 	if err = json.Unmarshal(ctx.PostBody(), &body); err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadRequest, err.Error())
+	}
+	if err = body.Validate(); err != nil {
+		return invalid(ctx, err)
+	}
+	if !webhook(body.URL) {
+		return invalid(ctx, notWebhook)
+	}
+	body = body.WithDefaults()
+	body.ID = t.NewID()
+	body.Owner = owner(ctx)
+
+	// the creations of one client are checked one at a time, each counts
+	// until the receiver lists it
+	reserved := ac.reserved.of(body.Owner)
+	defer reserved.Unlock()
+
+	listed, err := ac.listed(body.Owner)
+	if err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadGateway, err.Error())
+	}
+	if reserved.count(listed, time.Now()) >= ac.maxAlerts {
+		return routing.NewHTTPError(fasthttp.StatusTooManyRequests, fmt.Sprintf("alert quota of %d reached", ac.maxAlerts))
+	}
+
+	b, err := json.Marshal(&body)
+	if err != nil {
 		return err
 	}
 
-	if err = ac.channel.Publish(
-		"",
-		ac.queue.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        ctx.PostBody(),
-		},
-	); err != nil {
+	if err = ac.publish(broker.Created, b); err != nil {
+		return err
+	}
+	reserved.add(body.ID, time.Now())
+
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": "subscribe", "id": body.ID})
+	return nil
+}
+
+// invalid answers 422 with every field that failed validation.
+func invalid(ctx *routing.Context, err error) error {
+	fields, ok := err.(t.ValidationError)
+	if !ok {
+		return routing.NewHTTPError(fasthttp.StatusUnprocessableEntity, err.Error())
+	}
+	respond.WithJSON(ctx, fasthttp.StatusUnprocessableEntity, t.Payload{"error": "invalid alert", "fields": fields})
+	return nil
+}
+
+func (ac *apiController) publish(event string, body []byte) error {
+	if err := ac.broker.Publish(event, body); err != nil {
+		if errors.Cause(err) == broker.ErrUnavailable {
+			return routing.NewHTTPError(fasthttp.StatusServiceUnavailable, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// notWebhook is returned for alerts to a chat of the bot, which only
+// the bot may create.
+var notWebhook = t.ValidationError{{Field: "url", Message: "must be an http(s) URL"}}
+
+func webhook(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// alerts lists the alerts of the client, optionally only those of a url.
+func (ac *apiController) alerts(ctx *routing.Context) error {
+	blocks, err := ac.receiver.Alerts(owner(ctx), string(ctx.QueryArgs().Peek("url")))
+	if err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadGateway, err.Error())
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": blocks})
+	return nil
+}
+
+func (ac *apiController) alertByID(ctx *routing.Context) error {
+	block, ok, err := ac.receiver.Alert(ctx.Param("id"), owner(ctx))
+	if err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadGateway, err.Error())
+	}
+	if !ok {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "alert not found")
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": block})
+	return nil
+}
+
+// updateAlert and deleteAlert publish the change to every receiver, the
+// one holding the alert applies it.
+func (ac *apiController) updateAlert(ctx *routing.Context) error {
+	var body t.Alert
+	if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadRequest, err.Error())
+	}
+	if err := body.ValidatePatch(); err != nil {
+		return invalid(ctx, err)
+	}
+	if body.URL != "" && !webhook(body.URL) {
+		return invalid(ctx, notWebhook)
+	}
+	body.ID = ctx.Param("id")
+	body.Owner = owner(ctx)
+	return ac.change(ctx, broker.Updated, body)
+}
+
+func (ac *apiController) deleteAlert(ctx *routing.Context) error {
+	return ac.change(ctx, broker.Deleted, t.Alert{ID: ctx.Param("id"), Owner: owner(ctx)})
+}
+
+// change publishes the change of an alert the client owns, the
+// receivers check the owner again before they apply it.
+func (ac *apiController) change(ctx *routing.Context, event string, body t.Alert) error {
+	ok, err := ac.owns(body.ID, body.Owner)
+	if err != nil {
+		return routing.NewHTTPError(fasthttp.StatusBadGateway, err.Error())
+	}
+	if !ok {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "alert not found")
+	}
+
+	b, err := json.Marshal(&body)
+	if err != nil {
+		return err
+	}
+	if err := ac.publish(event, b); err != nil {
 		return err
 	}
 
-	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": "subscribe"})
+	respond.WithJSON(ctx, fasthttp.StatusAccepted, t.Payload{"result": event, "id": body.ID})
 	return nil
 }
 
+// owns asks the receiver whether the alert belongs to the client.
+func (ac *apiController) owns(id, client string) (bool, error) {
+	_, ok, err := ac.receiver.Alert(id, client)
+	return ok, err
+}
+
 func (ac *apiController) healthCheck(ctx *routing.Context) error {
 	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": "alive"})
 	return nil
 }
 
 func (s *Server) initAlertAPI() {
-	s.G.Post("/alert", s.ac.alert)
 	s.G.Get("/health-check", s.ac.healthCheck)
+
+	s.G.Use(s.auth, s.limit)
+	s.G.Post("/alert", s.ac.alert)
+	s.G.Get("/alerts", s.ac.alerts)
+	s.G.Get("/alerts/<id>", s.ac.alertByID)
+	s.G.Patch("/alerts/<id>", s.ac.updateAlert)
+	s.G.Delete("/alerts/<id>", s.ac.deleteAlert)
 }
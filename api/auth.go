@@ -0,0 +1,110 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	clientKey    = "client"
+)
+
+// apiKeys maps the clients to their keys. They come from the JSON object
+// in API_KEYS_FILE and from API_KEYS, "client:key" pairs separated with
+// commas.
+type apiKeys map[string]string
+
+func loadKeys() (apiKeys, error) {
+	keys := make(apiKeys)
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "api keys file")
+		}
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return nil, errors.Wrap(err, "api keys file")
+		}
+		// the client is the owner of its alerts, the receiver refuses
+		// an empty one
+		for client, key := range keys {
+			if client == "" || key == "" {
+				return nil, errors.Errorf("api keys file: client %q has no name or no key", client)
+			}
+		}
+	}
+
+	for _, pair := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("api keys: %q is not client:key", pair)
+		}
+		keys[kv[0]] = kv[1]
+	}
+
+	if len(keys) == 0 {
+		log.Println("no api keys configured, every request will be refused")
+	}
+	return keys, nil
+}
+
+// client returns the client the key belongs to.
+func (k apiKeys) client(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	for client, clientKey := range k {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(clientKey)) == 1 {
+			return client, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) auth(ctx *routing.Context) error {
+	client, ok := s.keys.client(string(ctx.Request.Header.Peek(apiKeyHeader)))
+	if !ok {
+		ctx.Abort()
+		return routing.NewHTTPError(fasthttp.StatusUnauthorized, "invalid api key")
+	}
+	ctx.Set(clientKey, client)
+	return ctx.Next()
+}
+
+// owner is the client authenticated by auth.
+func owner(ctx *routing.Context) string {
+	client, _ := ctx.Get(clientKey).(string)
+	return client
+}
+
+// origins is the CORS allowlist from CORS_ORIGINS, "*" allows any.
+type origins map[string]struct{}
+
+func loadOrigins() origins {
+	o := make(origins)
+	for _, origin := range strings.Split(os.Getenv("CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			o[origin] = struct{}{}
+		}
+	}
+	return o
+}
+
+func (o origins) allowed(origin string) bool {
+	if _, ok := o["*"]; ok {
+		return true
+	}
+	_, ok := o[origin]
+	return ok
+}
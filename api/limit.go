@@ -0,0 +1,137 @@
+package api
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultRate      = 5
+	defaultBurst     = 20
+	defaultMaxAlerts = 100
+
+	// a created alert the receiver doesn't list after this long was
+	// most likely lost on its way
+	reservationTTL = 10 * time.Minute
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket per client: each client may do burst
+// requests at once and then rate requests a second.
+type limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter(rate, burst int) *limiter {
+	return &limiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take spends a token of the client, when there is none it returns how
+// long to wait for the next one.
+func (l *limiter) take(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (s *Server) limit(ctx *routing.Context) error {
+	ok, wait := s.limiter.take(owner(ctx), time.Now())
+	if !ok {
+		ctx.Abort()
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return routing.NewHTTPError(fasthttp.StatusTooManyRequests, "rate limit exceeded")
+	}
+	return ctx.Next()
+}
+
+// reservations hold the alerts each client created that the receiver
+// may not list yet, alerts reach it through the broker a moment later.
+// Without them a burst of creations would all pass the quota.
+type reservations struct {
+	mu      sync.Mutex
+	clients map[string]*reserved
+}
+
+type reserved struct {
+	// held while the quota of the client is checked and taken
+	sync.Mutex
+	ids map[string]time.Time
+}
+
+func newReservations() *reservations {
+	return &reservations{clients: make(map[string]*reserved)}
+}
+
+// of returns the reservations of the client, locked.
+func (rs *reservations) of(client string) *reserved {
+	rs.mu.Lock()
+	r, ok := rs.clients[client]
+	if !ok {
+		r = &reserved{ids: make(map[string]time.Time)}
+		rs.clients[client] = r
+	}
+	rs.mu.Unlock()
+
+	r.Lock()
+	return r
+}
+
+// count returns how many alerts the client has, those listed by the
+// receiver and those still on their way to it.
+func (r *reserved) count(listed map[string]bool, now time.Time) int {
+	for id, at := range r.ids {
+		if listed[id] || now.Sub(at) > reservationTTL {
+			delete(r.ids, id)
+		}
+	}
+	return len(listed) + len(r.ids)
+}
+
+func (r *reserved) add(id string, now time.Time) {
+	r.ids[id] = now
+}
+
+// listed returns the ids of the alerts of the client on the receiver.
+func (ac *apiController) listed(client string) (map[string]bool, error) {
+	blocks, err := ac.receiver.Alerts(client, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(blocks))
+	for _, b := range blocks {
+		ids[b.ID] = true
+	}
+	return ids, nil
+}
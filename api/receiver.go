@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/url"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	"github.com/imroc/req"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// Receiver answers what the api asks about the alerts, which the
+// receiver holds. The api binary asks it over HTTP, the all-in-one one
+// calls it directly.
+type Receiver interface {
+	// Alerts returns the alerts of the owner, only those of url when
+	// it isn't empty.
+	Alerts(owner, url string) ([]cache.ConditionBlock, error)
+	// Alert returns the alert with the id when it belongs to the owner.
+	Alert(id, owner string) (cache.ConditionBlock, bool, error)
+}
+
+// httpReceiver asks the receiver API at PROCESSING_API_URL.
+type httpReceiver struct {
+	url string
+}
+
+func (hr httpReceiver) Alerts(owner, u string) ([]cache.ConditionBlock, error) {
+	q := req.QueryParam{"owner": owner}
+	if u != "" {
+		q["url"] = u
+	}
+	resp, err := req.Get(hr.url+"alerts", q)
+	if err != nil {
+		return nil, err
+	}
+	if status := resp.Response().StatusCode; status != fasthttp.StatusOK {
+		return nil, errors.Errorf("receiver answered %d", status)
+	}
+
+	var body struct {
+		Result []cache.ConditionBlock `json:"result"`
+	}
+	if err := resp.ToJSON(&body); err != nil {
+		return nil, err
+	}
+	return body.Result, nil
+}
+
+func (hr httpReceiver) Alert(id, owner string) (cache.ConditionBlock, bool, error) {
+	var body struct {
+		Result cache.ConditionBlock `json:"result"`
+	}
+	resp, err := req.Get(hr.url+"alerts/"+url.PathEscape(id), req.QueryParam{"owner": owner})
+	if err != nil {
+		return body.Result, false, err
+	}
+	switch status := resp.Response().StatusCode; status {
+	case fasthttp.StatusOK:
+	case fasthttp.StatusNotFound:
+		return body.Result, false, nil
+	default:
+		return body.Result, false, errors.Errorf("receiver answered %d", status)
+	}
+
+	if err := resp.ToJSON(&body); err != nil {
+		return body.Result, false, err
+	}
+	return body.Result, true, nil
+}
@@ -4,39 +4,59 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/pkg/env"
 	"github.com/button-tech/utils-rate-alerts/pkg/rabbitmq"
 	t "github.com/button-tech/utils-rate-alerts/types"
 	"github.com/pkg/errors"
 	routing "github.com/qiangxue/fasthttp-routing"
-	"github.com/streadway/amqp"
 	"github.com/valyala/fasthttp"
 )
 
 type Server struct {
-	Core     *fasthttp.Server
-	WG       sync.WaitGroup
-	R        *routing.Router
-	G        *routing.RouteGroup
-	ac       *apiController
-	rabbitMQ *rabbitmq.Instance
+	Core    *fasthttp.Server
+	WG      sync.WaitGroup
+	R       *routing.Router
+	G       *routing.RouteGroup
+	ac      *apiController
+	broker  broker.Broker
+	rcv     Receiver
+	keys    apiKeys
+	origins origins
+	limiter *limiter
 }
 
 func NewServer() (*Server, error) {
-	server := Server{
-		R:  routing.New(),
-		WG: sync.WaitGroup{},
-	}
-	server.R.Use(cors)
-	server.fs()
-
 	r, err := rabbitmq.NewInstance()
 	if err != nil {
 		return nil, errors.Wrap(err, "rabbitMQ instance declaration")
 	}
-	server.rabbitMQ = r
+	return NewServerWithBroker(broker.NewAMQP(r), httpReceiver{url: os.Getenv("PROCESSING_API_URL")})
+}
+
+// NewServerWithBroker builds the server on top of the given broker,
+// asking rcv about the alerts.
+func NewServerWithBroker(b broker.Broker, rcv Receiver) (*Server, error) {
+	keys, err := loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	server := Server{
+		R:       routing.New(),
+		WG:      sync.WaitGroup{},
+		broker:  b,
+		rcv:     rcv,
+		keys:    keys,
+		origins: loadOrigins(),
+		limiter: newLimiter(env.Int("RATE_LIMIT", defaultRate), env.Int("RATE_BURST", defaultBurst)),
+	}
+	server.R.Use(server.cors)
+	server.fs()
 
 	server.initBaseRoute()
 	server.initAlertAPI()
@@ -45,24 +65,22 @@ func NewServer() (*Server, error) {
 }
 
 func (s *Server) Finalize() {
-	log.Println("rabbitMQ channel close...")
-	if err := s.ac.channel.Close(); err != nil {
-		return
-	}
-
-	log.Println("rabbitMQ connection close...")
-	if err := s.rabbitMQ.Conn.Close(); err != nil {
-		return
+	if err := s.broker.Close(); err != nil {
+		log.Println(err)
 	}
 }
 
-func cors(ctx *routing.Context) error {
-	ctx.Response.Header.Set("Access-Control-Allow-Origin", string(ctx.Request.Header.Peek("Origin")))
+// cors allows only the origins of CORS_ORIGINS.
+func (s *Server) cors(ctx *routing.Context) error {
+	ctx.Response.Header.Set("Vary", "Origin")
+	if origin := string(ctx.Request.Header.Peek("Origin")); origin != "" && s.origins.allowed(origin) {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+	}
 	ctx.Response.Header.Set("Access-Control-Allow-Credentials", "false")
-	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET,HEAD,PUT,POST,DELETE")
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET,HEAD,PUT,PATCH,POST,DELETE")
 	ctx.Response.Header.Set(
 		"Access-Control-Allow-Headers",
-		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization",
+		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, "+apiKeyHeader,
 	)
 
 	if string(ctx.Method()) == "OPTIONS" {
@@ -96,8 +114,10 @@ func (s *Server) fs() {
 func (s *Server) initBaseRoute() {
 	s.G = s.R.Group("/api/v1")
 	s.ac = &apiController{
-		channel: s.rabbitMQ.Channel,
-		queue:   s.rabbitMQ.Queue,
+		broker:    s.broker,
+		receiver:  s.rcv,
+		maxAlerts: env.Int("MAX_ALERTS_PER_KEY", defaultMaxAlerts),
+		reserved:  newReservations(),
 	}
 }
 
@@ -110,6 +130,8 @@ func respondWithJSON(ctx *routing.Context, code int, payload t.Payload) {
 }
 
 type apiController struct {
-	channel *amqp.Channel
-	queue   amqp.Queue
+	broker    broker.Broker
+	receiver  Receiver
+	maxAlerts int
+	reserved  *reservations
 }
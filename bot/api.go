@@ -5,14 +5,11 @@ import (
 	"github.com/button-tech/utils-rate-alerts/pkg/respond"
 	t "github.com/button-tech/utils-rate-alerts/types"
 	routing "github.com/qiangxue/fasthttp-routing"
-	"github.com/streadway/amqp"
 	"github.com/valyala/fasthttp"
 )
 
 type apiController struct {
-	channel *amqp.Channel
-	queue   amqp.Queue
-	b       *Bot
+	b *Bot
 }
 
 func (ac *apiController) botAlert(ctx *routing.Context) error {
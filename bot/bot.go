@@ -4,21 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/imroc/req"
-	"github.com/pkg/errors"
 	"log"
 	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/pkg/env"
 	processCache "github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
 	t "github.com/button-tech/utils-rate-alerts/types"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
-	"github.com/streadway/amqp"
 	"os"
 )
 
 type userAlert struct {
+	id        string
 	currency  string
 	condition string
 	price     string
@@ -39,28 +39,41 @@ func keyGen(k int64) string {
 	return strconv.FormatInt(k, 10)
 }
 
-func SetupBot(c *amqp.Channel, q amqp.Queue, t string) BotProvider {
+func SetupBot(b broker.Broker, t string) BotProvider {
 	return BotProvider{
-		Channel:  c,
-		Queue:    q,
+		Broker:   b,
 		BotToken: t,
+		Storage:  stateStorage(),
 	}
 }
 
+const defaultMaxAlerts = 20
+
+// maxAlerts is how many alerts one chat may have, MAX_ALERTS_PER_CHAT.
+func maxAlerts() int {
+	return env.Int("MAX_ALERTS_PER_CHAT", defaultMaxAlerts)
+}
+
+func stateStorage() storage {
+	if p := os.Getenv("BOT_STATE_PATH"); p != "" {
+		return newFileStorage(p)
+	}
+	return newFileStorage("bot-state.json")
+}
+
 type BotProvider struct {
-	Channel      *amqp.Channel
-	Queue        amqp.Queue
+	Broker       broker.Broker
 	BotToken     string
 	ProcessCache *processCache.Cache
+	Storage      storage
 }
 
 type Bot struct {
-	api                 *tgbotapi.BotAPI
-	tgChannel           tgbotapi.UpdatesChannel
-	cache               *cache
-	deleteProcessingURL string
-	channel             *amqp.Channel
-	queue               amqp.Queue
+	api       *tgbotapi.BotAPI
+	tgChannel tgbotapi.UpdatesChannel
+	cache     *cache
+	broker    broker.Broker
+	maxAlerts int
 }
 
 func (b *Bot) AlertUser(c t.TrueCondition) error {
@@ -70,12 +83,14 @@ func (b *Bot) AlertUser(c t.TrueCondition) error {
 	if err != nil {
 		return err
 	}
-	value := genAlertValue(c.Values.Currency, c.Values.Fiat, c.Values.Price, c.Values.Condition)
-	alerts, _ := b.cache.getRawAlerts(chatID)
-	for i, a := range alerts {
-		if a == value {
-			alerts = append(alerts[:i], alerts[i+1:]...)
-			b.cache.setRawAlerts(chatID, alerts)
+	if c.Mode != t.ModeRecurring {
+		value := genAlertValue(c.Values.Currency, c.Values.Fiat, c.Values.Price, c.Values.Condition, c.ID)
+		alerts, _ := b.cache.getRawAlerts(chatID)
+		for i, a := range alerts {
+			if a == value {
+				alerts = append(alerts[:i], alerts[i+1:]...)
+				b.cache.setRawAlerts(chatID, alerts)
+			}
 		}
 	}
 
@@ -85,47 +100,63 @@ func (b *Bot) AlertUser(c t.TrueCondition) error {
 }
 
 func (b *Bot) subscribeUser(args t.Alert) error {
+	if err := args.Validate(); err != nil {
+		return err
+	}
 	body, err := json.Marshal(&args)
 	if err != nil {
 		return err
 	}
 
-	err = b.channel.Publish(
-		"",
-		b.queue.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-	return err
+	return b.broker.Publish(broker.Created, body)
 }
 
-// currency, fiat, price, condition
-// [Token(b.Currency)][Fiat(b.Fiat)][URL(b.URL
+// currency, fiat, price, condition, id
 func (b *Bot) deleteFromProcessCache(chatID int64, language, alert string) error {
 	convChatID := strconv.FormatInt(chatID, 10)
 	url := fmt.Sprintf("%s_%s", convChatID, language)
-	splitted := strings.Split(alert, "_")
+	a := parseAlertValue(alert)
 	block := processCache.ConditionBlock{
-		Currency: splitted[0],
-		Fiat:     splitted[1],
+		ID:       a.id,
+		Currency: a.currency,
+		Fiat:     a.fiat,
 		URL:      url,
 	}
 
-	resp, err := req.Post(b.deleteProcessingURL+"delete", req.BodyJSON(&block))
+	body, err := json.Marshal(&block)
 	if err != nil {
 		return err
 	}
 
-	if resp.Response().StatusCode != 201 {
-		return errors.New("response status: not ok")
-	}
+	return b.broker.Publish(broker.Deleted, body)
+}
 
-	return nil
+// ProcessingTriggers sends the alerts triggered on the receiver to the
+// users until the broker is closed.
+func (b *Bot) ProcessingTriggers() {
+	triggers, err := b.broker.ConsumeTriggers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
+	for msg := range triggers {
+		var c t.TrueCondition
+		err := json.Unmarshal(msg.Body, &c)
+		if err == nil {
+			err = b.AlertUser(c)
+		}
+		if err != nil {
+			log.Println(err)
+			if err := msg.DeadLetter(err); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if err := msg.Ack(); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
@@ -142,8 +173,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 				if _, ok := b.cache.get(chatID); ok {
 					b.cache.delete(chatID)
 				}
-				username := update.CallbackQuery.Message.Chat.UserName
-				language = b.cache.setupLanguage(username, update.CallbackQuery.Data)
+				language = b.cache.setupLanguage(chatID, update.CallbackQuery.Data)
 				msg := help(chatID, language)
 				msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
 				if _, err := b.api.Send(msg); err != nil {
@@ -157,7 +187,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 
 			chatID := update.Message.Chat.ID
 			var ok bool
-			ok, language = b.cache.checkLanguage(update.Message.Chat.UserName)
+			ok, language = b.cache.checkLanguage(chatID)
 			if !ok {
 				language = "english"
 			}
@@ -167,6 +197,12 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 				if _, ok := b.cache.get(chatID); ok {
 					b.cache.delete(chatID)
 				}
+				if alerts, _ := b.cache.getRawAlerts(chatID); len(alerts) >= b.maxAlerts {
+					if _, err := b.api.Send(tgbotapi.NewMessage(chatID, quotaMessage(language, b.maxAlerts))); err != nil {
+						log.Println(err)
+					}
+					continue
+				}
 				p := page{userInput: "", number: 0}
 				b.cache.set(chatID, p)
 				text := p.giveContent(0, language)
@@ -213,27 +249,26 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 					continue
 				}
 
-				deleted, ok := b.cache.deleteAlert(chatID, cmd)
-				if !ok {
+				deleted, ok := b.cache.alertAt(chatID, cmd)
+				switch {
+				case !ok:
 					msg = tgbotapi.NewMessage(chatID, selectAlertNumber(language))
-				} else {
+				case deleted != "":
+					// the chat keeps the alert until the receivers are told
+					if err := b.deleteFromProcessCache(chatID, language, deleted); err != nil {
+						log.Println(err)
+						msg.Text = selectErrAlertMessage(language)
+						break
+					}
+					b.cache.deleteAlert(chatID, deleted)
+					fallthrough
+				default:
 					alerts, ok := b.cache.getAlerts(chatID)
-					var text string
-					if !ok {
-						text = selectNoAlertMessage(language)
+					if !ok || alerts == "" {
+						msg.Text = selectNoAlertMessage(language)
 					} else {
-						if alerts == "" {
-							text = selectNoAlertMessage(language)
-						} else {
-							text = alerts
-						}
-					}
-					if deleted != "" {
-						if err := b.deleteFromProcessCache(chatID, language, deleted); err != nil {
-							text = selectNoAlertMessage(language)
-						}
+						msg.Text = alerts
 					}
-					msg.Text = text
 				}
 
 				if _, err := b.api.Send(msg); err != nil {
@@ -263,6 +298,9 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 				if len(pages) == 4 {
 					msg.ReplyMarkup = backKeyboard(language)
 				}
+				if len(pages) == 5 {
+					msg.ReplyMarkup = conditionsKeyboard(language)
+				}
 				if len(pages) <= 1 {
 					msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
 				}
@@ -274,8 +312,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			}
 
 			if pages[len(pages)-1].number == 0 {
-				_, ok := cryptoCurrencies[strings.ToUpper(userText)]
-				if !ok {
+				if !t.ValidToken(userText) {
 					msg := tgbotapi.NewMessage(chatID, handleErrorInput(0, language))
 					if _, err := b.api.Send(msg); err != nil {
 						log.Println(err)
@@ -285,8 +322,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			}
 
 			if pages[len(pages)-1].number == 1 {
-				_, ok := fiats[strings.ToUpper(userText)]
-				if !ok {
+				if !t.ValidFiat(userText) {
 					msg := tgbotapi.NewMessage(chatID, handleErrorInput(1, language))
 					if _, err := b.api.Send(msg); err != nil {
 						log.Println(err)
@@ -296,8 +332,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			}
 
 			if pages[len(pages)-1].number == 2 {
-				_, err := strconv.ParseFloat(userText, 10)
-				if err != nil {
+				if !t.ValidPrice(userText) {
 					if _, err := b.api.Send(tgbotapi.NewMessage(chatID, handleErrorInput(2, language))); err != nil {
 						log.Println(err)
 					}
@@ -306,7 +341,7 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			}
 
 			if pages[len(pages)-1].number == 3 {
-				if _, ok := conditionsVerifier[userText]; !ok {
+				if !t.ValidCondition(userText) {
 					if _, err := b.api.Send(tgbotapi.NewMessage(chatID, handleErrorInput(3, language))); err != nil {
 						log.Println(err)
 					}
@@ -314,6 +349,15 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 				}
 			}
 
+			if pages[len(pages)-1].number == 4 {
+				if _, ok := modes[language][userText]; !ok {
+					if _, err := b.api.Send(tgbotapi.NewMessage(chatID, handleErrorInput(5, language))); err != nil {
+						log.Println(err)
+					}
+					continue
+				}
+			}
+
 			p := page{
 				userInput: userText,
 				number:    pages[len(pages)-1].number + 1,
@@ -321,20 +365,21 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			pages = b.cache.set(chatID, p)
 			var msg tgbotapi.MessageConfig
 
-			if pages[len(pages)-1].number == 4 {
+			if pages[len(pages)-1].number == 5 {
 				alert := splitArgs(pages[1:], chatID, language)
 				var text string
-				b.cache.setAlert(
-					chatID,
-					pages[len(pages)-4].userInput,
-					pages[len(pages)-3].userInput,
-					pages[len(pages)-2].userInput,
-					pages[len(pages)-1].userInput,
-				)
-
 				if err := b.subscribeUser(alert); err != nil {
+					log.Println(err)
 					text = handleErrorInput(4, language)
 				} else {
+					b.cache.setAlert(
+						chatID,
+						pages[len(pages)-5].userInput,
+						pages[len(pages)-4].userInput,
+						pages[len(pages)-3].userInput,
+						pages[len(pages)-2].userInput,
+						alert.ID,
+					)
 					text = alertMessage(language)
 				}
 				msg = tgbotapi.NewMessage(chatID, text)
@@ -346,6 +391,9 @@ func (b *Bot) ProcessingUpdates(ctx context.Context, wg *sync.WaitGroup) {
 				if len(pages) == 4 {
 					msg.ReplyMarkup = conditionsKeyboard(language)
 				}
+				if len(pages) == 5 {
+					msg.ReplyMarkup = modeKeyboard(language)
+				}
 			}
 			if _, err := b.api.Send(msg); err != nil {
 				log.Println(err)
@@ -367,13 +415,17 @@ func CreateBot(p BotProvider) (*Bot, error) {
 		return nil, err
 	}
 
+	c, err := newCache(p.Storage)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Bot{
-		api:                 bot,
-		tgChannel:           updates,
-		channel:             p.Channel,
-		queue:               p.Queue,
-		cache:               newCache(),
-		deleteProcessingURL: os.Getenv("PROCESSING_API_URL"),
+		api:       bot,
+		tgChannel: updates,
+		broker:    p.Broker,
+		cache:     c,
+		maxAlerts: maxAlerts(),
 	}, nil
 }
 
@@ -400,11 +452,14 @@ func completedAlertMessage(c t.TrueCondition, language string) string {
 func splitArgs(args []page, chatID int64, language string) t.Alert {
 	convChatID := strconv.FormatInt(chatID, 10)
 	l := fmt.Sprintf("%s_%s", convChatID, language)
-	return t.Alert{
+	a := t.Alert{
+		ID:        t.NewID(),
 		Currency:  args[0].userInput,
 		Fiat:      args[1].userInput,
 		Price:     args[2].userInput,
 		Condition: args[3].userInput,
+		Mode:      modes[language][args[4].userInput],
 		URL:       l,
 	}
+	return a.WithDefaults()
 }
@@ -2,6 +2,7 @@ package bot
 
 import (
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,37 +13,86 @@ type cache struct {
 	subscribers map[string][]page
 	language    map[string]string
 	alerts      map[string][]string
+	storage     storage
 }
 
-func newCache() *cache {
-	return &cache{
+func newCache(s storage) (*cache, error) {
+	c := &cache{
 		mu:          sync.Mutex{},
 		subscribers: make(map[string][]page),
 		language:    make(map[string]string),
 		alerts:      make(map[string][]string),
+		storage:     s,
 	}
+
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if st != nil {
+		if st.Subscribers != nil {
+			c.subscribers = st.Subscribers
+		}
+		if st.Language != nil {
+			c.language = st.Language
+		}
+		if st.Alerts != nil {
+			c.alerts = st.Alerts
+		}
+	}
+	return c, nil
 }
 
-func (c *cache) setAlert(chatID int64, currency, fiat, price, condition string) {
+// persist must be called with c.mu held.
+func (c *cache) persist() {
+	err := c.storage.save(&state{
+		Subscribers: c.subscribers,
+		Language:    c.language,
+		Alerts:      c.alerts,
+	})
+	if err != nil {
+		log.Println("bot state save:", err)
+	}
+}
+
+func (c *cache) setAlert(chatID int64, currency, fiat, price, condition, id string) {
 	k := keyGenForAlert(chatID)
 	c.mu.Lock()
 	val, ok := c.alerts[k]
 	if !ok {
 		c.alerts[k] = make([]string, 0)
 	}
-	val = append(val, genAlertValue(currency, fiat, price, condition))
+	val = append(val, genAlertValue(currency, fiat, price, condition, id))
 	c.alerts[k] = val
+	c.persist()
 	c.mu.Unlock()
 }
 
-func genAlertValue(currency, fiat, price, condition string) string {
-	return fmt.Sprintf("%s_%s_%s_%s", currency, fiat, price, condition)
+func genAlertValue(currency, fiat, price, condition, id string) string {
+	return fmt.Sprintf("%s_%s_%s_%s_%s", currency, fiat, price, condition, id)
+}
+
+// parseAlertValue is the reverse of genAlertValue; the condition
+// may contain underscores itself, e.g. crosses_above.
+func parseAlertValue(v string) userAlert {
+	items := strings.Split(v, "_")
+	if len(items) < 5 {
+		return userAlert{}
+	}
+	return userAlert{
+		currency:  items[0],
+		fiat:      items[1],
+		price:     items[2],
+		condition: strings.Join(items[3:len(items)-1], "_"),
+		id:        items[len(items)-1],
+	}
 }
 
 func (c *cache) setRawAlerts(chatID int64, alerts []string) {
 	k := keyGenForAlert(chatID)
 	c.mu.Lock()
 	c.alerts[k] = alerts
+	c.persist()
 	c.mu.Unlock()
 }
 
@@ -67,13 +117,7 @@ func (c *cache) getAlerts(chatID int64) (a string, ok bool) {
 	}
 
 	for i, v := range val {
-		alertItems := strings.Split(v, "_")
-		u := userAlert{
-			currency:  alertItems[0],
-			fiat:      alertItems[1],
-			price:     alertItems[2],
-			condition: alertItems[3],
-		}
+		u := parseAlertValue(v)
 		one := fmt.Sprintf(
 			"%s %s %s %s",
 			strings.ToUpper(u.currency),
@@ -86,8 +130,9 @@ func (c *cache) getAlerts(chatID int64) (a string, ok bool) {
 	return
 }
 
-func (c *cache) deleteAlert(chatID int64, alert string) (string, bool) {
-	var deleted string
+// alertAt returns the alert with the number the chat was shown, an empty
+// one when the chat has no alerts.
+func (c *cache) alertAt(chatID int64, alert string) (string, bool) {
 	k := keyGenForAlert(chatID)
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -101,27 +146,40 @@ func (c *cache) deleteAlert(chatID int64, alert string) (string, bool) {
 		return "", false
 	}
 
-	if len(val) >= numb {
-		deleted = val[numb-1]
-		val = append(val[:numb-1], val[numb-1+1:]...)
-		c.alerts[k] = val
-		return deleted, true
+	if numb >= 1 && len(val) >= numb {
+		return val[numb-1], true
 	}
 
 	return "", false
 }
 
-func (c *cache) checkLanguage(username string) (bool, string) {
+// deleteAlert drops the alert of the chat, once its deletion is published.
+func (c *cache) deleteAlert(chatID int64, alert string) {
+	k := keyGenForAlert(chatID)
 	c.mu.Lock()
-	l, ok := c.language[username]
+	defer c.mu.Unlock()
+	val := c.alerts[k]
+	for i, v := range val {
+		if v == alert {
+			c.alerts[k] = append(val[:i], val[i+1:]...)
+			c.persist()
+			return
+		}
+	}
+}
+
+func (c *cache) checkLanguage(chatID int64) (bool, string) {
+	c.mu.Lock()
+	l, ok := c.language[keyGen(chatID)]
 	c.mu.Unlock()
 	return ok, l
 }
 
-func (c *cache) setupLanguage(username, language string) string {
+func (c *cache) setupLanguage(chatID int64, language string) string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.language[username] = language
+	c.language[keyGen(chatID)] = language
+	c.persist()
 	return language
 }
 
@@ -135,10 +193,13 @@ func (c *cache) set(k int64, p page) []page {
 	}
 	val = append(val, p)
 	c.subscribers[key] = val
+	c.persist()
 	return val
 }
 
 func (c *cache) get(k int64) (ps []page, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	key := keyGen(k)
 	if ps, ok = c.subscribers[key]; !ok {
 		return nil, false
@@ -153,14 +214,17 @@ func (c *cache) back(k int64) {
 	ps := c.subscribers[key]
 	if len(ps) <= 1 {
 		delete(c.subscribers, key)
+		c.persist()
 		return
 	}
 	c.subscribers[key] = ps[:len(ps)-1]
+	c.persist()
 }
 
 func (c *cache) delete(k int64) {
 	c.mu.Lock()
 	key := keyGen(k)
 	delete(c.subscribers, key)
+	c.persist()
 	c.mu.Unlock()
 }
@@ -3,6 +3,7 @@ package bot
 import (
 	"context"
 	"encoding/json"
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
 	"github.com/button-tech/utils-rate-alerts/pkg/rabbitmq"
 	"github.com/button-tech/utils-rate-alerts/pkg/respond"
 	t "github.com/button-tech/utils-rate-alerts/types"
@@ -17,36 +18,41 @@ import (
 )
 
 type Server struct {
-	Core     *fasthttp.Server
-	WG       sync.WaitGroup
-	Bot      *Bot
-	R        *routing.Router
-	G        *routing.RouteGroup
-	ac       *apiController
-	rabbitMQ *rabbitmq.Instance
+	Core   *fasthttp.Server
+	WG     sync.WaitGroup
+	Bot    *Bot
+	R      *routing.Router
+	G      *routing.RouteGroup
+	ac     *apiController
+	broker broker.Broker
 }
 
 func NewServer(ctx context.Context) (*Server, error) {
-	server := Server{
-		R:  routing.New(),
-		WG: sync.WaitGroup{},
-	}
-	server.R.Use(cors)
-	server.fs()
-
 	r, err := rabbitmq.NewInstance()
 	if err != nil {
 		return nil, errors.Wrap(err, "rabbitMQ instance declaration")
 	}
-	server.rabbitMQ = r
+	return NewServerWithBroker(ctx, broker.NewAMQP(r))
+}
 
-	bp := SetupBot(r.Channel, r.Queue, os.Getenv("BOT_TOKEN"))
+// NewServerWithBroker builds the bot server on top of the given broker.
+func NewServerWithBroker(ctx context.Context, br broker.Broker) (*Server, error) {
+	server := Server{
+		R:      routing.New(),
+		WG:     sync.WaitGroup{},
+		broker: br,
+	}
+	server.R.Use(cors)
+	server.fs()
+
+	bp := SetupBot(br, os.Getenv("BOT_TOKEN"))
 	b, err := CreateBot(bp)
 	if err != nil {
 		return nil, err
 	}
 	server.WG.Add(1)
 	go b.ProcessingUpdates(ctx, &server.WG)
+	go b.ProcessingTriggers()
 	server.Bot = b
 
 	server.initBaseRoute()
@@ -56,14 +62,8 @@ func NewServer(ctx context.Context) (*Server, error) {
 }
 
 func (s *Server) Finalize() {
-	log.Println("rabbitMQ channel close...")
-	if err := s.ac.channel.Close(); err != nil {
-		return
-	}
-
-	log.Println("rabbitMQ connection close...")
-	if err := s.rabbitMQ.Conn.Close(); err != nil {
-		return
+	if err := s.broker.Close(); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -108,8 +108,6 @@ func (s *Server) fs() {
 func (s *Server) initBaseRoute() {
 	s.G = s.R.Group("/api/tel-bot")
 	s.ac = &apiController{
-		channel: s.rabbitMQ.Channel,
-		queue:   s.rabbitMQ.Queue,
-		b:       s.Bot,
+		b: s.Bot,
 	}
 }
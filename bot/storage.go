@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/file"
+)
+
+type state struct {
+	Subscribers map[string][]page   `json:"subscribers"`
+	Language    map[string]string   `json:"language"`
+	Alerts      map[string][]string `json:"alerts"`
+}
+
+// storage keeps the bot state between restarts.
+type storage interface {
+	load() (*state, error)
+	save(s *state) error
+}
+
+type fileStorage struct {
+	path string
+}
+
+func newFileStorage(path string) *fileStorage {
+	return &fileStorage{path: path}
+}
+
+func (fs *fileStorage) load() (*state, error) {
+	b, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s state
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (fs *fileStorage) save(s *state) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return file.Replace(fs.path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+type pageJSON struct {
+	Number    int    `json:"number"`
+	UserInput string `json:"userInput"`
+}
+
+func (p page) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pageJSON{Number: p.number, UserInput: p.userInput})
+}
+
+func (p *page) UnmarshalJSON(b []byte) error {
+	var pj pageJSON
+	if err := json.Unmarshal(b, &pj); err != nil {
+		return err
+	}
+	p.number = pj.Number
+	p.userInput = pj.UserInput
+	return nil
+}
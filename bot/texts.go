@@ -2,6 +2,7 @@ package bot
 
 import (
 	"fmt"
+	t "github.com/button-tech/utils-rate-alerts/types"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"strings"
 )
@@ -26,42 +27,56 @@ const (
 	secondPageRUS = `Выберите фиатную валюту:
 Пример: USD
 `
-	thirdPageRUS = `Введите сумму в %s:
+	thirdPageRUS = `Введите сумму в %s или процент изменения:
 Пример: 7000`
 	fourthPageRUS = `Введите условие:
 Пример: <= или >= или == или < или >
+~= - цена примерно равна сумме
++% - рост, -% - падение, ±% - изменение цены на процент от текущей
+crosses_above, crosses_below - цена пересекает сумму снизу вверх или сверху вниз
 `
+	fifthPageRUS = `Как часто уведомлять?
+Однократно или постоянно, не чаще раза в час`
 	firstPageENG = `Select crypto currency:
 Example: BTC 
 `
 	secondPageENG = `Select fiat currency:
 Example: USD
 `
-	thirdPageENG = `Enter the amount in %s:
+	thirdPageENG = `Enter the amount in %s or the percent of change:
 Example: 7000`
 	fourthPageENG = `Enter the condition:
-Example: <= или >= или == или < или >
+Example: <= or >= or == or < or >
+~= - the price is about the amount
++% - rise, -% - drop, ±% - move by the percent from the current price
+crosses_above, crosses_below - the price crosses the amount upwards or downwards
 `
+	fifthPageENG = `How often to notify?
+Once or recurring, at most once an hour`
 )
 
 const (
 	errCryptoInputRUS     = "❌ Попробуйте другую крипто валюту\nПример: BTC"
 	errFiatInputRUS       = "❌ Попробуйте другую фиатную валюту\nПример: USD"
 	errPriceInputRUS      = "❌ Введите валидную сумму\nПример: 7000"
-	errConditionInputRUS  = "❌ Введите доступное условие\nПример: <= или >= или == или < или >"
+	errConditionInputRUS  = "❌ Введите доступное условие\nПример: <= или >= или == или < или > или ~= или +% или -% или ±% или crosses_above или crosses_below"
 	errAlertMsgRUS        = `❌ Произошла ошибка. Попробуйте позже`
+	errModeInputRUS       = "❌ Выберите однократно или постоянно"
 	alertMessageRUS       = `✅ Вы подписаны на уведомление`
 	noAlertsMessageRUS    = `💤 Вы не подписаны на уведомления`
 	invalidAlertNumberRUS = "❌ Неверный номер уведомления"
+	errQuotaRUS           = "❌ У вас уже %d уведомлений, это максимум\nУдалите одно командой /delete"
 
 	errCryptoInputENG     = "❌ Try another crypto currency\nExample: BTC"
 	errFiatInputENG       = "❌ Try another fiat currency\nExample: USD"
 	errPriceInputENG      = "❌ Enter valid amount\nExample: 7000"
-	errConditionInputENG  = "❌ Enter an available condition\nExample: <= или >= или == или < или >"
+	errConditionInputENG  = "❌ Enter an available condition\nExample: <= or >= or == or < or > or ~= or +% or -% or ±% or crosses_above or crosses_below"
 	errAlertMsgENG        = `❌ An error has occurred. try late`
+	errModeInputENG       = "❌ Choose once or recurring"
 	alertMessageENG       = `✅ You subscribed to the notification`
 	noAlertsMessageENG    = `💤 You have't got alerts`
 	invalidAlertNumberENG = "❌ Invalid alert number"
+	errQuotaENG           = "❌ You already have %d alerts, that's the limit\nDelete one with /delete"
 )
 
 func selectAlertNumber(language string) (m string) {
@@ -84,6 +99,26 @@ func selectNoAlertMessage(language string) (m string) {
 	return
 }
 
+func selectErrAlertMessage(language string) (m string) {
+	switch language {
+	case "russian":
+		m = errAlertMsgRUS
+	case "english":
+		m = errAlertMsgENG
+	}
+	return
+}
+
+func quotaMessage(language string, max int) (m string) {
+	switch language {
+	case "russian":
+		m = errQuotaRUS
+	case "english":
+		m = errQuotaENG
+	}
+	return fmt.Sprintf(m, max)
+}
+
 func selectLanguageMsg(language string) (l string) {
 	switch language {
 	case "russian":
@@ -108,6 +143,8 @@ func handleErrorInput(page int64, language string) (err string) {
 			err = errConditionInputRUS
 		case 4:
 			err = errAlertMsgRUS
+		case 5:
+			err = errModeInputRUS
 		}
 	case "english":
 		switch page {
@@ -121,6 +158,8 @@ func handleErrorInput(page int64, language string) (err string) {
 			err = errConditionInputENG
 		case 4:
 			err = errAlertMsgENG
+		case 5:
+			err = errModeInputENG
 		}
 	}
 	return err
@@ -148,6 +187,8 @@ func (p *page) giveContent(page int, language string) (c string) {
 			c = fmt.Sprintf(thirdPageRUS, strings.ToUpper(p.userInput))
 		case 3:
 			c = fourthPageRUS
+		case 4:
+			c = fifthPageRUS
 		case -1:
 			c = helpMessageRUS
 		}
@@ -161,6 +202,8 @@ func (p *page) giveContent(page int, language string) (c string) {
 			c = fmt.Sprintf(thirdPageENG, strings.ToUpper(p.userInput))
 		case 3:
 			c = fourthPageENG
+		case 4:
+			c = fifthPageENG
 		case -1:
 			c = helpMessageENG
 		}
@@ -169,17 +212,6 @@ func (p *page) giveContent(page int, language string) (c string) {
 	return
 }
 
-var fiats = map[string]struct{}{"AED": {}, "ALL": {}, "AMD": {}, "AOA": {}, "ARS": {}, "AUD": {}, "BAM": {}, "BDT": {}, "BGN": {}, "BHD": {}, "BIF": {}, "BND": {}, "BOB": {}, "BRL": {}, "BSD": {}, "BTC": {}, "BTN": {}, "BWP": {}, "BYN": {}, "CAD": {}, "CDF": {}, "CHF": {}, "CLP": {}, "CNY": {}, "COP": {}, "CRC": {}, "CZK": {}, "DKK": {}, "DOP": {}, "DZD": {}, "EGP": {}, "ETB": {}, "EUR": {}, "GBP": {}, "GEL": {}, "GGP": {}, "GHS": {}, "GIP": {}, "GTQ": {}, "HKD": {}, "HNL": {}, "HRK": {}, "HUF": {}, "IDR": {}, "ILS": {}, "INR": {}, "IQD": {}, "IRR": {}, "ISK": {}, "JMD": {}, "JOD": {}, "JPY": {}, "KES": {}, "KGS": {}, "KHR": {}, "KRW": {}, "KWD": {}, "KZT": {}, "LBP": {}, "LKR": {}, "LSL": {}, "MAD": {}, "MDL": {}, "MMK": {}, "MOP": {}, "MUR": {}, "MWK": {}, "MXN": {}, "MYR": {}, "NAD": {}, "NGN": {}, "NIO": {}, "NOK": {}, "NPR": {}, "NZD": {}, "OMR": {}, "PAB": {}, "PEN": {}, "PGK": {}, "PHP": {}, "PKR": {}, "PLN": {}, "PYG": {}, "QAR": {}, "RON": {}, "RUB": {}, "RWF": {}, "SAR": {}, "SBD": {}, "SEK": {}, "SGD": {}, "SHP": {}, "SZL": {}, "THB": {}, "TMT": {}, "TND": {}, "TOP": {}, "TRY": {}, "TTD": {}, "TWD": {}, "TZS": {}, "UAH": {}, "UGX": {}, "USD": {}, "UYU": {}, "UZS": {}, "VEF": {}, "VND": {}, "VUV": {}, "XAF": {}, "XAU": {}, "XCD": {}, "XOF": {}, "ZAR": {}, "ZMW": {}}
-var cryptoCurrencies = map[string]struct{}{"ADA": {}, "AE": {}, "ALGO": {}, "ARDR": {}, "ATOM": {}, "BCD": {}, "BCH": {}, "BCN": {}, "BNB": {}, "BSV": {}, "BTC": {}, "BTG": {}, "BTM": {}, "BTS": {}, "BTT": {}, "CENNZ": {}, "DASH": {}, "DCR": {}, "DGB": {}, "DOGE": {}, "EOS": {}, "ETC": {}, "ETH": {}, "ICX": {}, "IOST": {}, "KMD": {}, "LSK": {}, "LTC": {}, "LUNA": {}, "MONA": {}, "NANO": {}, "NEO": {}, "NRG": {}, "ONT": {}, "QTUM": {}, "RVN": {}, "STEEM": {}, "STRAT": {}, "THETA": {}, "TOMO": {}, "TRX": {}, "VET": {}, "VSYS": {}, "WAVES": {}, "XEM": {}, "XLM": {}, "XMR": {}, "XRP": {}, "XTZ": {}, "XVG": {}, "ZEC": {}, "ZEN": {}, "ZIL": {}}
-
-var conditionsVerifier = map[string]struct{}{
-	">":  {},
-	"<":  {},
-	"==": {},
-	">=": {},
-	"<=": {},
-}
-
 func backKeyboard(language string) tgbotapi.ReplyKeyboardMarkup {
 	var data string
 	switch language {
@@ -206,14 +238,48 @@ func conditionsKeyboard(language string) tgbotapi.ReplyKeyboardMarkup {
 			tgbotapi.NewKeyboardButton("<=")),
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(">"),
+			tgbotapi.NewKeyboardButton("~="),
 			tgbotapi.NewKeyboardButton("<"),
 		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton("+%"),
+			tgbotapi.NewKeyboardButton("-%"),
+			tgbotapi.NewKeyboardButton("±%"),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton("crosses_above"),
+			tgbotapi.NewKeyboardButton("crosses_below"),
+		),
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(text),
 		),
 	)
 }
 
+var modes = map[string]map[string]string{
+	"russian": {"однократно": t.ModeOnce, "постоянно": t.ModeRecurring},
+	"english": {"once": t.ModeOnce, "recurring": t.ModeRecurring},
+}
+
+func modeKeyboard(language string) tgbotapi.ReplyKeyboardMarkup {
+	var once, recurring, back string
+	switch language {
+	case "russian":
+		once, recurring, back = "однократно", "постоянно", "назад"
+	case "english":
+		once, recurring, back = "once", "recurring", "back"
+	}
+	return tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(once),
+			tgbotapi.NewKeyboardButton(recurring),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(back),
+		),
+	)
+}
+
 var languagesKeyBoard = tgbotapi.NewInlineKeyboardMarkup(
 	tgbotapi.NewInlineKeyboardRow(
 		tgbotapi.NewInlineKeyboardButtonData("🇷🇺", "russian"),
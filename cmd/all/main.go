@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/button-tech/utils-rate-alerts/api"
+	"github.com/button-tech/utils-rate-alerts/bot"
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/receiver"
+	"github.com/valyala/fasthttp"
+)
+
+// the same ports as the separate binaries
+const (
+	apiPort      = ":5001"
+	botPort      = ":5055"
+	receiverPort = ":5050"
+
+	queueSize = 1024
+)
+
+// all runs the api, the bot and the receiver in one process, the alert
+// events between them go through an in-memory broker and the api asks
+// the receiver about the alerts directly. Nothing in the queue survives
+// a restart, it is meant for development and small staging setups.
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := broker.NewMemory(queueSize)
+
+	r, err := receiver.NewWithBroker(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bs, err := bot.NewServerWithBroker(ctx, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	as, err := api.NewServerWithBroker(b, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signalEx := make(chan os.Signal, 1)
+	defer close(signalEx)
+
+	signal.Notify(signalEx,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+
+	listen(r.Server, receiverPort)
+	listen(bs.Core, botPort)
+	listen(as.Core, apiPort)
+
+	log.Println("Start processing")
+	go r.Processing()
+	go r.Membership()
+	go r.Election()
+	go r.GetPrices()
+	go r.Deliver()
+
+	defer r.Finalize()
+	defer bs.Finalize()
+	defer as.Finalize()
+	defer shutdown(r.Server, bs.Core, as.Core)
+
+	stop := <-signalEx
+	cancel()
+	log.Println("Received", stop)
+	bs.WG.Wait()
+	log.Println("Waiting for all jobs to stop")
+}
+
+func listen(s *fasthttp.Server, port string) {
+	go func() {
+		log.Printf("start http server on port:%s", port)
+		if err := s.ListenAndServe(port); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+func shutdown(ss ...*fasthttp.Server) {
+	for _, s := range ss {
+		if err := s.Shutdown(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -35,7 +35,10 @@ func main() {
 
 	log.Println("Start processing")
 	go r.Processing()
+	go r.Membership()
+	go r.Election()
 	go r.GetPrices()
+	go r.Deliver()
 
 	defer r.Finalize()
 	defer func() {
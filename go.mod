@@ -15,5 +15,4 @@ require (
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
 	github.com/valyala/fasthttp v1.8.0
 	github.com/valyala/fastjson v1.4.5
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 )
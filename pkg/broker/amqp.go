@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"github.com/button-tech/utils-rate-alerts/pkg/rabbitmq"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+type AMQP struct {
+	i *rabbitmq.Instance
+}
+
+func NewAMQP(i *rabbitmq.Instance) *AMQP {
+	return &AMQP{i: i}
+}
+
+func (a *AMQP) Publish(event string, body []byte) error {
+	err := a.i.PublishConfirmed(
+		event,
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		},
+	)
+	switch errors.Cause(err) {
+	case rabbitmq.ErrNotConnected, rabbitmq.ErrNotConfirmed, rabbitmq.ErrUnroutable:
+		return errors.Wrap(ErrUnavailable, err.Error())
+	}
+	return err
+}
+
+func (a *AMQP) ConsumeSubscriptions() (<-chan Delivery, error) {
+	return a.consume(a.i.Queue.Name)
+}
+
+func (a *AMQP) ConsumeChanges() (<-chan Delivery, error) {
+	msgs, err := a.i.ConsumeChanges(rabbitmq.Prefetch())
+	if err != nil {
+		return nil, err
+	}
+	return a.deliveries(msgs), nil
+}
+
+func (a *AMQP) ConsumeMembership() (<-chan Delivery, error) {
+	msgs, err := a.i.ConsumeMembership()
+	if err != nil {
+		return nil, err
+	}
+	return a.deliveries(msgs), nil
+}
+
+func (a *AMQP) ConsumeTriggers() (<-chan Delivery, error) {
+	return a.consume(a.i.TriggerQueue.Name)
+}
+
+func (a *AMQP) consume(queue string) (<-chan Delivery, error) {
+	msgs, err := a.i.Consume(queue, rabbitmq.Prefetch())
+	if err != nil {
+		return nil, err
+	}
+	return a.deliveries(msgs), nil
+}
+
+func (a *AMQP) deliveries(msgs <-chan amqp.Delivery) <-chan Delivery {
+
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for msg := range msgs {
+			msg := msg
+			out <- Delivery{
+				Event: msg.RoutingKey,
+				Body:  msg.Body,
+				ack: func() error {
+					return msg.Ack(false)
+				},
+				requeue: func() error {
+					return msg.Nack(false, true)
+				},
+				deadLetter: func(reason error) error {
+					return a.i.DeadLetter(msg, reason)
+				},
+			}
+		}
+	}()
+	return out
+}
+
+func (a *AMQP) Lease() (<-chan struct{}, error) {
+	lost, err := a.i.Lease()
+	if err == rabbitmq.ErrLeaseHeld {
+		return nil, ErrLeaseHeld
+	}
+	return lost, err
+}
+
+func (a *AMQP) Close() error {
+	return a.i.Close()
+}
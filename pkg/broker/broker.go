@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"github.com/button-tech/utils-rate-alerts/pkg/rabbitmq"
+	"github.com/pkg/errors"
+)
+
+// Events, the routing keys of the messages.
+const (
+	Created   = rabbitmq.KeyCreated
+	Deleted   = rabbitmq.KeyDeleted
+	Updated   = rabbitmq.KeyUpdated
+	Synced    = rabbitmq.KeySynced
+	Triggered = rabbitmq.KeyTriggered
+	Heartbeat = rabbitmq.KeyHeartbeat
+	Left      = rabbitmq.KeyLeft
+)
+
+var (
+	// ErrUnavailable is returned when the broker can't take a message
+	// now, the caller may try again later.
+	ErrUnavailable = errors.New("broker unavailable")
+	// ErrLeaseHeld is returned by Lease while another instance leads.
+	ErrLeaseHeld = errors.New("lease is held by another instance")
+)
+
+// Broker carries alert events between the api, the bot and the receiver.
+// Created alerts are shared out among the receivers as subscriptions,
+// deleted, updated and synced ones reach every receiver as changes,
+// triggered ones go to the bot. The receivers find each other through
+// the membership events, or elect a leader with Lease, whose channel is
+// closed once the lease is lost.
+type Broker interface {
+	Publish(event string, body []byte) error
+	ConsumeSubscriptions() (<-chan Delivery, error)
+	ConsumeChanges() (<-chan Delivery, error)
+	ConsumeTriggers() (<-chan Delivery, error)
+	ConsumeMembership() (<-chan Delivery, error)
+	Lease() (<-chan struct{}, error)
+	Close() error
+}
+
+// InstanceID names this process among the receivers, set it with
+// RABBIT_MQ_INSTANCE_ID, by default it is the hostname.
+func InstanceID() string {
+	return rabbitmq.InstanceID()
+}
+
+// Delivery is a consumed message, it must be settled with exactly one
+// of Ack, Requeue or DeadLetter.
+type Delivery struct {
+	Event string
+	Body  []byte
+
+	ack        func() error
+	requeue    func() error
+	deadLetter func(reason error) error
+}
+
+func (d Delivery) Ack() error {
+	return d.ack()
+}
+
+// Requeue returns the message to the broker to be delivered again.
+func (d Delivery) Requeue() error {
+	return d.requeue()
+}
+
+// DeadLetter removes a message that can never be processed.
+func (d Delivery) DeadLetter(reason error) error {
+	return d.deadLetter(reason)
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const publishTimeout = 5 * time.Second
+
+// DeadLetter is a message the consumer gave up on.
+type DeadLetter struct {
+	Event  string
+	Body   []byte
+	Reason string
+}
+
+type message struct {
+	event string
+	body  []byte
+}
+
+// Memory is an in-process broker on Go channels, for development and
+// tests; messages don't survive the process.
+type Memory struct {
+	subscriptions chan message
+	triggers      chan message
+	buffer        int
+	timeout       time.Duration
+
+	mu          sync.Mutex
+	fanout      map[string][]chan message
+	deadLetters []DeadLetter
+	leased      bool
+	done        chan struct{}
+	closed      bool
+}
+
+func NewMemory(buffer int) *Memory {
+	return &Memory{
+		subscriptions: make(chan message, buffer),
+		triggers:      make(chan message, buffer),
+		buffer:        buffer,
+		timeout:       publishTimeout,
+		fanout:        make(map[string][]chan message),
+		done:          make(chan struct{}),
+	}
+}
+
+func (m *Memory) Publish(event string, body []byte) error {
+	msg := message{event: event, body: body}
+	switch event {
+	case Triggered:
+		return m.send(m.triggers, msg)
+	case Created:
+		return m.send(m.subscriptions, msg)
+	}
+
+	m.mu.Lock()
+	qs := m.fanout[group(event)]
+	m.mu.Unlock()
+	for _, q := range qs {
+		if err := m.send(q, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// group tells which fanout consumers get the event.
+func group(event string) string {
+	switch event {
+	case Heartbeat, Left:
+		return "members"
+	}
+	return "changes"
+}
+
+func (m *Memory) send(q chan message, msg message) error {
+	select {
+	case <-m.done:
+		return errors.Wrap(ErrUnavailable, "closed")
+	default:
+	}
+
+	timeout := time.NewTimer(m.timeout)
+	defer timeout.Stop()
+	select {
+	case q <- msg:
+		return nil
+	case <-m.done:
+		return errors.Wrap(ErrUnavailable, "closed")
+	case <-timeout.C:
+		return errors.Wrap(ErrUnavailable, "queue is full")
+	}
+}
+
+func (m *Memory) ConsumeSubscriptions() (<-chan Delivery, error) {
+	return m.consume(m.subscriptions), nil
+}
+
+// ConsumeChanges and ConsumeMembership give every consumer its own copy
+// of the events published after the call.
+func (m *Memory) ConsumeChanges() (<-chan Delivery, error) {
+	return m.subscribe("changes"), nil
+}
+
+func (m *Memory) ConsumeMembership() (<-chan Delivery, error) {
+	return m.subscribe("members"), nil
+}
+
+func (m *Memory) subscribe(g string) <-chan Delivery {
+	q := make(chan message, m.buffer)
+	m.mu.Lock()
+	m.fanout[g] = append(m.fanout[g], q)
+	m.mu.Unlock()
+	return m.consume(q)
+}
+
+func (m *Memory) ConsumeTriggers() (<-chan Delivery, error) {
+	return m.consume(m.triggers), nil
+}
+
+func (m *Memory) consume(q chan message) <-chan Delivery {
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for {
+			var msg message
+			select {
+			case <-m.done:
+				return
+			case msg = <-q:
+			}
+
+			d := Delivery{
+				Event: msg.event,
+				Body:  msg.body,
+				ack: func() error {
+					return nil
+				},
+				// the consumer may be the only reader of q, so
+				// requeue must not wait for room in it
+				requeue: func() error {
+					go m.requeue(q, msg)
+					return nil
+				},
+				deadLetter: func(reason error) error {
+					m.bury(msg, reason)
+					return nil
+				},
+			}
+			select {
+			case <-m.done:
+				return
+			case out <- d:
+			}
+		}
+	}()
+	return out
+}
+
+// requeue puts msg back on q, a message that doesn't fit is kept with
+// the dead letters rather than lost.
+func (m *Memory) requeue(q chan message, msg message) {
+	if err := m.send(q, msg); err != nil {
+		log.Printf("memory broker: requeue %s: %s", msg.event, err)
+		m.bury(msg, errors.Wrap(err, "requeue"))
+	}
+}
+
+func (m *Memory) bury(msg message, reason error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters = append(m.deadLetters, DeadLetter{
+		Event:  msg.event,
+		Body:   msg.body,
+		Reason: reason.Error(),
+	})
+}
+
+func (m *Memory) DeadLetters() []DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dl := make([]DeadLetter, len(m.deadLetters))
+	copy(dl, m.deadLetters)
+	return dl
+}
+
+// Lease is granted once, for the life of the broker.
+func (m *Memory) Lease() (<-chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.leased {
+		return nil, ErrLeaseHeld
+	}
+	m.leased = true
+	return m.done, nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func receive(t *testing.T, c <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-c:
+		if !ok {
+			t.Fatal("consumer closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+	}
+	return Delivery{}
+}
+
+func nothing(t *testing.T, c <-chan Delivery) {
+	t.Helper()
+	select {
+	case d := <-c:
+		t.Fatalf("unexpected delivery %s %s", d.Event, d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryPublishConsumeAck(t *testing.T) {
+	m := NewMemory(4)
+	defer m.Close()
+
+	subs, _ := m.ConsumeSubscriptions()
+	triggers, _ := m.ConsumeTriggers()
+
+	if err := m.Publish(Created, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(Triggered, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, subs)
+	if d.Event != Created || string(d.Body) != "a" {
+		t.Fatalf("got %s %s, want %s a", d.Event, d.Body, Created)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	nothing(t, subs)
+
+	if d := receive(t, triggers); d.Event != Triggered || string(d.Body) != "b" {
+		t.Fatalf("got %s %s, want %s b", d.Event, d.Body, Triggered)
+	}
+}
+
+func TestMemoryRequeue(t *testing.T) {
+	m := NewMemory(4)
+	defer m.Close()
+
+	subs, _ := m.ConsumeSubscriptions()
+	if err := m.Publish(Created, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receive(t, subs).Requeue(); err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, subs)
+	if string(d.Body) != "a" {
+		t.Fatalf("got %s after requeue, want a", d.Body)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	nothing(t, subs)
+}
+
+func TestMemoryRequeueFullQueue(t *testing.T) {
+	m := NewMemory(1)
+	defer m.Close()
+
+	subs, _ := m.ConsumeSubscriptions()
+	if err := m.Publish(Created, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	a := receive(t, subs)
+
+	// "b" waits in the consumer and "c" fills the queue, "a" has no
+	// room to go back to
+	for _, body := range []string{"b", "c"} {
+		if err := m.Publish(Created, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.timeout = 10 * time.Millisecond
+	if err := a.Requeue(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(m.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	dl := m.DeadLetters()
+	if len(dl) != 1 || string(dl[0].Body) != "a" {
+		t.Fatalf("dead letters %+v, want the requeued a", dl)
+	}
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	m := NewMemory(4)
+	defer m.Close()
+
+	triggers, _ := m.ConsumeTriggers()
+	if err := m.Publish(Triggered, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, triggers).DeadLetter(errors.New("bad")); err != nil {
+		t.Fatal(err)
+	}
+
+	dl := m.DeadLetters()
+	if len(dl) != 1 || dl[0].Event != Triggered || dl[0].Reason != "bad" {
+		t.Fatalf("dead letters %+v", dl)
+	}
+	nothing(t, triggers)
+}
+
+func TestMemoryFanout(t *testing.T) {
+	m := NewMemory(4)
+	defer m.Close()
+
+	first, _ := m.ConsumeChanges()
+	second, _ := m.ConsumeChanges()
+	members, _ := m.ConsumeMembership()
+
+	if err := m.Publish(Deleted, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []<-chan Delivery{first, second} {
+		if d := receive(t, c); d.Event != Deleted {
+			t.Fatalf("got %s, want %s", d.Event, Deleted)
+		}
+	}
+	nothing(t, members)
+
+	if err := m.Publish(Heartbeat, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, members); d.Event != Heartbeat {
+		t.Fatalf("got %s, want %s", d.Event, Heartbeat)
+	}
+	nothing(t, first)
+}
+
+func TestMemoryClose(t *testing.T) {
+	m := NewMemory(4)
+	subs, _ := m.ConsumeSubscriptions()
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(Created, []byte("a")); errors.Cause(err) != ErrUnavailable {
+		t.Fatalf("publish after close: %v", err)
+	}
+	select {
+	case _, ok := <-subs:
+		if ok {
+			t.Fatal("delivery after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer not closed")
+	}
+}
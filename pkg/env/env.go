@@ -0,0 +1,24 @@
+package env
+
+import (
+	"os"
+	"strconv"
+)
+
+// Or returns the variable key, or fallback when it is empty.
+func Or(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Int returns the variable key as a positive number, or fallback when
+// it is unset or isn't one.
+func Int(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
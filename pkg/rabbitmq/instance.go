@@ -1,52 +1,621 @@
 package rabbitmq
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/env"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
-	"os"
 )
 
+// Routing keys of the events on the exchange.
+const (
+	KeyCreated   = "alert.created"
+	KeyDeleted   = "alert.deleted"
+	KeyUpdated   = "alert.updated"
+	KeySynced    = "alert.synced"
+	KeyTriggered = "alert.triggered"
+	KeyHeartbeat = "receiver.heartbeat"
+	KeyLeft      = "receiver.left"
+)
+
+const (
+	defaultPrefetch = 10
+	minReconnect    = time.Second
+	maxReconnect    = 30 * time.Second
+	confirmTimeout  = 5 * time.Second
+	// a changes queue nobody has consumed for a day is dropped
+	changesExpire = int32(24 * time.Hour / time.Millisecond)
+)
+
+var (
+	// ErrNotConnected is returned by Publish while the connection to the
+	// broker is being restored.
+	ErrNotConnected = errors.New("rabbitMQ: connection lost, reconnecting")
+	// ErrNotConfirmed is returned by PublishConfirmed when the broker
+	// rejects the message or does not answer in time.
+	ErrNotConfirmed = errors.New("rabbitMQ: message was not confirmed by the broker")
+	// ErrLeaseHeld is returned by Lease while another connection holds it.
+	ErrLeaseHeld = errors.New("rabbitMQ: lease is held by another instance")
+	// ErrUnroutable is returned by PublishConfirmed when no queue is
+	// bound to the routing key.
+	ErrUnroutable = errors.New("rabbitMQ: no queue takes the message")
+)
+
+// Instance keeps a connection to the broker and restores it, with the
+// queues and the consumers, whenever the broker goes away.
 type Instance struct {
-	Conn    *amqp.Connection
-	Channel *amqp.Channel
-	Queue   amqp.Queue
+	Queue           amqp.Queue
+	TriggerQueue    amqp.Queue
+	DeadLetterQueue amqp.Queue
+
+	url      string
+	topology Topology
+
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	ready   chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+
+	// confirmed publishing goes through its own channel in confirm
+	// mode, one message at a time
+	pubMu     sync.Mutex
+	pubCh     *amqp.Channel
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return
+	published uint64
 }
 
-func NewInstance() (*Instance, error) {
-	conn, err := amqp.Dial(os.Getenv("RABBIT_MQ_CONN_URL"))
-	if err != nil {
-		return nil, errors.Wrap(err, "rabbitMQ connection")
+// Topology names the exchange and the queues. Queue takes created alerts
+// for the receivers, TriggerQueue the triggered ones for the bot. Every
+// receiver has its own ChangesQueue with the deleted, updated and synced
+// ones and a MembersQueue with the heartbeats of the others. LeaseQueue
+// is declared exclusive by the receiver that leads.
+type Topology struct {
+	Exchange        string
+	Queue           string
+	TriggerQueue    string
+	DeadLetterQueue string
+	LeaseQueue      string
+}
+
+func topology() Topology {
+	q := env.Or("RABBIT_MQ_QUEUE", "alert")
+	return Topology{
+		Exchange:        env.Or("RABBIT_MQ_EXCHANGE", "alerts"),
+		Queue:           q,
+		TriggerQueue:    env.Or("RABBIT_MQ_TRIGGER_QUEUE", "alert.triggered"),
+		DeadLetterQueue: env.Or("RABBIT_MQ_DEAD_LETTER_QUEUE", "alert.dead"),
+		LeaseQueue:      q + ".leader",
 	}
+}
 
-	ch, err := conn.Channel()
+// ChangesQueue and MembersQueue are named after the instance, only the
+// receivers ask for them.
+func (t Topology) ChangesQueue() string {
+	return t.Queue + ".changes." + InstanceID()
+}
+
+func (t Topology) MembersQueue() string {
+	return t.Queue + ".members." + InstanceID()
+}
+
+var instance struct {
+	once sync.Once
+	id   string
+}
+
+// InstanceID tells the receivers apart. Unless RABBIT_MQ_INSTANCE_ID is
+// set, it is made up on the first run and kept in the file at
+// RABBIT_MQ_INSTANCE_ID_FILE, next to the subscriptions: the changes
+// queue of the receiver keeps its name across restarts and new
+// hostnames, so the changes sent while it was away wait for it.
+func InstanceID() string {
+	instance.once.Do(func() {
+		instance.id = instanceID()
+	})
+	return instance.id
+}
+
+func instanceID() string {
+	if id := os.Getenv("RABBIT_MQ_INSTANCE_ID"); id != "" {
+		return id
+	}
+
+	path := env.Or("RABBIT_MQ_INSTANCE_ID_FILE", "instance-id")
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id
+		}
+	}
+
+	h, err := os.Hostname()
 	if err != nil {
-		return nil, errors.Wrap(err, "rabbitMQ channel")
+		h = "default"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Println("rabbitMQ instance id:", err)
+		return h
 	}
+	id := h + "-" + hex.EncodeToString(suffix)
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		log.Println("rabbitMQ instance id:", err)
+		return h
+	}
+	return id
+}
 
+func NewInstance() (*Instance, error) {
 	i := Instance{
-		Conn:    conn,
-		Channel: ch,
+		url:      os.Getenv("RABBIT_MQ_CONN_URL"),
+		topology: topology(),
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
 	}
-	if err := i.queueSettings(); err != nil {
+	if err := i.connect(); err != nil {
 		return nil, err
 	}
+	go i.watch()
 
 	return &i, nil
 }
 
-func (i *Instance) queueSettings() error {
-	q, err := i.Channel.QueueDeclare(
-		"alert",
+func (i *Instance) connect() error {
+	conn, err := amqp.Dial(i.url)
+	if err != nil {
+		return errors.Wrap(err, "rabbitMQ connection")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "rabbitMQ channel")
+	}
+
+	q, tq, dq, err := queueSettings(ch, i.topology)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "rabbitMQ publishing channel")
+	}
+	if err := pubCh.Confirm(false); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "rabbitMQ confirm mode")
+	}
+	confirms := pubCh.NotifyPublish(make(chan amqp.Confirmation, 128))
+	returns := pubCh.NotifyReturn(make(chan amqp.Return, 128))
+
+	i.pubMu.Lock()
+	i.pubCh = pubCh
+	i.confirms = confirms
+	i.returns = returns
+	i.published = 0
+	i.pubMu.Unlock()
+
+	i.mu.Lock()
+	i.conn = conn
+	i.channel = ch
+	if i.Queue.Name == "" {
+		// the names never change, so readers may use them without the lock
+		i.Queue = q
+		i.TriggerQueue = tq
+		i.DeadLetterQueue = dq
+	}
+	close(i.ready)
+	i.mu.Unlock()
+
+	return nil
+}
+
+func queueSettings(ch *amqp.Channel, t Topology) (q, tq, dq amqp.Queue, err error) {
+	if err = ch.ExchangeDeclare(
+		t.Exchange,
+		"topic",
 		true,
 		false,
 		false,
 		false,
 		nil,
+	); err != nil {
+		return q, tq, dq, errors.Wrap(err, "exchange settings init")
+	}
+
+	q, err = declare(ch, t.Exchange, t.Queue, nil, KeyCreated)
+	if err != nil {
+		return q, tq, dq, errors.Wrap(err, "queue settings init")
+	}
+
+	tq, err = declare(ch, t.Exchange, t.TriggerQueue, nil, KeyTriggered)
+	if err != nil {
+		return q, tq, dq, errors.Wrap(err, "trigger queue settings init")
+	}
+
+	// dead letters are published straight to the queue, no bindings
+	dq, err = declare(ch, t.Exchange, t.DeadLetterQueue, nil)
+	if err != nil {
+		return q, tq, dq, errors.Wrap(err, "dead letter queue settings init")
+	}
+
+	return q, tq, dq, nil
+}
+
+func declare(ch *amqp.Channel, exchange, name string, args amqp.Table, keys ...string) (amqp.Queue, error) {
+	q, err := ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		args,
 	)
 	if err != nil {
-		return errors.Wrap(err, "queue settings init")
+		return q, err
 	}
-	i.Queue = q
 
-	return nil
+	for _, key := range keys {
+		if err := ch.QueueBind(q.Name, key, exchange, false, nil); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// watch waits for the connection or the channel to close and dials
+// the broker again with a growing pause between the attempts.
+func (i *Instance) watch() {
+	for {
+		i.mu.RLock()
+		conn, ch := i.conn, i.channel
+		i.mu.RUnlock()
+
+		i.pubMu.Lock()
+		pubCh := i.pubCh
+		i.pubMu.Unlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+		pubClosed := pubCh.NotifyClose(make(chan *amqp.Error, 1))
+
+		var reason *amqp.Error
+		select {
+		case <-i.done:
+			return
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		case reason = <-pubClosed:
+		}
+		log.Println("rabbitMQ connection lost:", reason)
+
+		i.mu.Lock()
+		i.ready = make(chan struct{})
+		i.mu.Unlock()
+		if !conn.IsClosed() {
+			conn.Close()
+		}
+
+		for pause := minReconnect; ; pause *= 2 {
+			if pause > maxReconnect {
+				pause = maxReconnect
+			}
+			select {
+			case <-i.done:
+				return
+			case <-time.After(pause):
+			}
+
+			err := i.connect()
+			if err == nil {
+				log.Println("rabbitMQ reconnected")
+				break
+			}
+			log.Println(err)
+		}
+	}
+}
+
+// current returns the live channel or ErrNotConnected.
+func (i *Instance) current() (*amqp.Channel, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	select {
+	case <-i.ready:
+		return i.channel, nil
+	default:
+		return nil, ErrNotConnected
+	}
+}
+
+func (i *Instance) waitReady() <-chan struct{} {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.ready
+}
+
+// PublishConfirmed sends the message to the exchange with the routing
+// key and waits until the broker confirms it has taken responsibility
+// for it. A message no queue takes fails with ErrUnroutable instead of
+// being dropped.
+func (i *Instance) PublishConfirmed(key string, msg amqp.Publishing) error {
+	return i.publishConfirmed(i.topology.Exchange, key, msg)
+}
+
+func (i *Instance) publishConfirmed(exchange, key string, msg amqp.Publishing) error {
+	if _, err := i.current(); err != nil {
+		return err
+	}
+
+	i.pubMu.Lock()
+	defer i.pubMu.Unlock()
+
+	// returns of earlier messages that timed out
+	for len(i.returns) > 0 {
+		<-i.returns
+	}
+
+	msg.DeliveryMode = amqp.Persistent
+	if err := i.pubCh.Publish(exchange, key, true, false, msg); err != nil {
+		return errors.Wrap(ErrNotConfirmed, err.Error())
+	}
+	i.published++
+	tag := i.published
+
+	timeout := time.NewTimer(confirmTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case c, ok := <-i.confirms:
+			if !ok {
+				return errors.Wrap(ErrNotConfirmed, "channel closed")
+			}
+			// confirmations of earlier messages that timed out
+			if c.DeliveryTag < tag {
+				continue
+			}
+			if !c.Ack {
+				return errors.Wrap(ErrNotConfirmed, "nack")
+			}
+			// the broker returns an unroutable message before it
+			// confirms it
+			select {
+			case r := <-i.returns:
+				return errors.Wrap(ErrUnroutable, r.RoutingKey)
+			default:
+			}
+			return nil
+		case <-timeout.C:
+			return errors.Wrap(ErrNotConfirmed, "timeout")
+		}
+	}
+}
+
+// Consume delivers the messages of the queue on a channel that outlives
+// reconnects: after each one the consumer is declared again.
+func (i *Instance) Consume(queue string, prefetch int) (<-chan amqp.Delivery, error) {
+	return i.consumeWith(queue, prefetch, nil)
+}
+
+// ConsumeChanges consumes the deleted, updated and synced alerts from
+// the queue of this instance, so every instance sees each change. The
+// queue is declared on every connect: it expires after a day without
+// consumers.
+func (i *Instance) ConsumeChanges(prefetch int) (<-chan amqp.Delivery, error) {
+	t := i.topology
+	return i.consumeWith(t.ChangesQueue(), prefetch, func(ch *amqp.Channel) error {
+		_, err := declare(ch, t.Exchange, t.ChangesQueue(), amqp.Table{"x-expires": changesExpire}, KeyDeleted, KeyUpdated, KeySynced)
+		return errors.Wrap(err, "changes queue settings init")
+	})
+}
+
+// ConsumeMembership consumes the heartbeats of the receivers. Old ones
+// are of no use, so the queue goes away with the connection.
+func (i *Instance) ConsumeMembership() (<-chan amqp.Delivery, error) {
+	t := i.topology
+	return i.consumeWith(t.MembersQueue(), 1, func(ch *amqp.Channel) error {
+		q, err := ch.QueueDeclare(
+			t.MembersQueue(),
+			false,
+			true,
+			true,
+			false,
+			nil,
+		)
+		if err != nil {
+			return errors.Wrap(err, "members queue settings init")
+		}
+		for _, key := range []string{KeyHeartbeat, KeyLeft} {
+			if err := ch.QueueBind(q.Name, key, t.Exchange, false, nil); err != nil {
+				return errors.Wrap(err, "members queue settings init")
+			}
+		}
+		return nil
+	})
+}
+
+func (i *Instance) consumeWith(queue string, prefetch int, setup func(*amqp.Channel) error) (<-chan amqp.Delivery, error) {
+	msgs, err := i.consume(queue, prefetch, setup)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			for d := range msgs {
+				out <- d
+			}
+
+			for {
+				select {
+				case <-i.done:
+					return
+				case <-i.waitReady():
+				}
+				if msgs, err = i.consume(queue, prefetch, setup); err == nil {
+					break
+				}
+				log.Println("rabbitMQ consume:", err)
+				time.Sleep(minReconnect)
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (i *Instance) consume(queue string, prefetch int, setup func(*amqp.Channel) error) (<-chan amqp.Delivery, error) {
+	ch, err := i.current()
+	if err != nil {
+		return nil, err
+	}
+	if setup != nil {
+		if err := setup(ch); err != nil {
+			return nil, err
+		}
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return nil, err
+	}
+	return ch.Consume(
+		queue,
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+}
+
+// Lease declares the exclusive lease queue, which only one connection
+// can hold at a time. The returned channel is closed when the lease is
+// lost together with the connection.
+func (i *Instance) Lease() (<-chan struct{}, error) {
+	if _, err := i.current(); err != nil {
+		return nil, err
+	}
+	i.mu.RLock()
+	conn := i.conn
+	i.mu.RUnlock()
+
+	// the broker closes the channel when the queue is taken, so the
+	// lease gets a channel of its own
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, errors.Wrap(err, "rabbitMQ lease channel")
+	}
+	if _, err := ch.QueueDeclare(
+		i.topology.LeaseQueue,
+		false,
+		true,
+		true,
+		false,
+		nil,
+	); err != nil {
+		// a channel error closes it on the broker, anything else
+		// leaves it open
+		ch.Close()
+		if e, ok := err.(*amqp.Error); ok && e.Code == amqp.ResourceLocked {
+			return nil, ErrLeaseHeld
+		}
+		return nil, errors.Wrap(err, "rabbitMQ lease")
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	lost := make(chan struct{})
+	go func() {
+		select {
+		case <-closed:
+		case <-i.done:
+		}
+		close(lost)
+	}()
+	return lost, nil
+}
+
+// Close stops reconnecting and closes the connection, calling it again
+// does nothing.
+func (i *Instance) Close() (err error) {
+	i.closed.Do(func() {
+		err = i.close()
+	})
+	return err
+}
+
+func (i *Instance) close() error {
+	close(i.done)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	log.Println("rabbitMQ channel close...")
+	if err := i.channel.Close(); err != nil {
+		log.Println(err)
+	}
+	i.pubMu.Lock()
+	if err := i.pubCh.Close(); err != nil {
+		log.Println(err)
+	}
+	i.pubMu.Unlock()
+
+	log.Println("rabbitMQ connection close...")
+	return i.conn.Close()
+}
+
+// Prefetch returns how many unacknowledged messages a consumer may hold,
+// configured with RABBIT_MQ_PREFETCH.
+func Prefetch() int {
+	return env.Int("RABBIT_MQ_PREFETCH", defaultPrefetch)
+}
+
+// DeadLetter moves a message that can never be processed to the dead
+// letter queue together with the reason and acknowledges the original.
+func (i *Instance) DeadLetter(d amqp.Delivery, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers["x-error"] = reason.Error()
+	headers["x-original-queue"] = i.queueOf(d.RoutingKey)
+	headers["x-routing-key"] = d.RoutingKey
+
+	if err := i.publishConfirmed(
+		"",
+		i.DeadLetterQueue.Name,
+		amqp.Publishing{
+			ContentType: d.ContentType,
+			Headers:     headers,
+			Body:        d.Body,
+		},
+	); err != nil {
+		return errors.Wrap(err, "dead letter publish")
+	}
+	return d.Ack(false)
+}
+
+func (i *Instance) queueOf(key string) string {
+	switch key {
+	case KeyTriggered:
+		return i.TriggerQueue.Name
+	case KeyDeleted, KeyUpdated, KeySynced:
+		return i.topology.ChangesQueue()
+	case KeyHeartbeat, KeyLeft:
+		return i.topology.MembersQueue()
+	}
+	return i.Queue.Name
 }
@@ -7,43 +7,76 @@ import (
 
 type Token string
 type Fiat string
-type URL string
+type ID string
+
+type Store interface {
+	Set(b ConditionBlock) error
+	Get() map[Token]map[Fiat]map[ID]ConditionBlock
+	Delete(id string) error
+	Find(id string) (ConditionBlock, bool)
+	FindByURL(url string) []ConditionBlock
+	FindByOwner(owner string) []ConditionBlock
+	Close() error
+}
 
 type Cache struct {
 	sync.Mutex
-	subscribers map[Token]map[Fiat]map[URL]ConditionBlock
+	subscribers map[Token]map[Fiat]map[ID]ConditionBlock
+	index       map[ID]ConditionBlock
 }
 
 type ConditionBlock struct {
+	ID           string `json:"id"`
 	Currency     string `json:"currency"`
 	CurrentPrice string `json:"currentPrice"`
 	Price        string `json:"price"`
 	Fiat         string `json:"fiat"`
 	Condition    string `json:"condition"`
-	URL          string `json:"url"`
+	Tolerance    string `json:"tolerance,omitempty"`
+	Window       string `json:"window,omitempty"`
+	BasePrice    string `json:"basePrice,omitempty"`
+	Mode         string `json:"mode,omitempty"`
+	Cooldown     string `json:"cooldown,omitempty"`
+	Hysteresis   string `json:"hysteresis,omitempty"`
+	FiredAt      int64  `json:"firedAt,omitempty"`
+	Disarmed     bool   `json:"disarmed,omitempty"`
+	// Quarantine is why the block is left out of evaluation, it can't
+	// be evaluated as it is
+	Quarantine    string `json:"quarantine,omitempty"`
+	QuarantinedAt int64  `json:"quarantinedAt,omitempty"`
+	// Owner is the api client that created the block, blocks of the
+	// bot have none
+	Owner string `json:"owner,omitempty"`
+	URL   string `json:"url"`
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		subscribers: make(map[Token]map[Fiat]map[URL]ConditionBlock),
+		subscribers: make(map[Token]map[Fiat]map[ID]ConditionBlock),
+		index:       make(map[ID]ConditionBlock),
 	}
 }
 
-func (c *Cache) Set(b ConditionBlock) {
+func (c *Cache) Set(b ConditionBlock) error {
 	c.Lock()
 	var ok bool
 
+	if old, ok := c.index[ID(b.ID)]; ok {
+		c.remove(old)
+	}
+
 	if ok = c.setCurrency(b); !ok {
-		c.subscribers[Token(b.Currency)] = make(map[Fiat]map[URL]ConditionBlock)
+		c.subscribers[Token(b.Currency)] = make(map[Fiat]map[ID]ConditionBlock)
 	}
 
 	if ok = c.setFiat(b); !ok {
-		c.subscribers[Token(b.Currency)][Fiat(b.Fiat)] = make(map[URL]ConditionBlock)
+		c.subscribers[Token(b.Currency)][Fiat(b.Fiat)] = make(map[ID]ConditionBlock)
 	}
 
-	c.setURL(b)
+	c.setID(b)
 
 	c.Unlock()
+	return nil
 }
 
 func (c *Cache) setCurrency(b ConditionBlock) bool {
@@ -56,26 +89,108 @@ func (c *Cache) setFiat(b ConditionBlock) bool {
 	return ok
 }
 
-func (c *Cache) setURL(b ConditionBlock) {
-	c.subscribers[Token(b.Currency)][Fiat(b.Fiat)][URL(b.URL)] = b
+func (c *Cache) setID(b ConditionBlock) {
+	c.subscribers[Token(b.Currency)][Fiat(b.Fiat)][ID(b.ID)] = b
+	c.index[ID(b.ID)] = b
 }
 
-func (c *Cache) Get() (m map[Token]map[Fiat]map[URL]ConditionBlock) {
+// Get returns a copy of the subscriptions, safe to range over while
+// they change.
+func (c *Cache) Get() map[Token]map[Fiat]map[ID]ConditionBlock {
 	c.Lock()
-	m = c.subscribers
-	c.Unlock()
-	return
+	defer c.Unlock()
+
+	m := make(map[Token]map[Fiat]map[ID]ConditionBlock, len(c.subscribers))
+	for token, fiats := range c.subscribers {
+		m[token] = make(map[Fiat]map[ID]ConditionBlock, len(fiats))
+		for fiat, ids := range fiats {
+			m[token][fiat] = make(map[ID]ConditionBlock, len(ids))
+			for id, b := range ids {
+				m[token][fiat][id] = b
+			}
+		}
+	}
+	return m
 }
 
-func (c *Cache) Delete(b ConditionBlock) error {
+func (c *Cache) Delete(id string) error {
 	c.Lock()
 	defer c.Unlock()
 
-	_, ok := c.subscribers[Token(b.Currency)][Fiat(b.Fiat)][URL(b.URL)]
+	b, ok := c.index[ID(id)]
 	if !ok {
 		return errors.New("no key in map")
 	}
-	delete(c.subscribers[Token(b.Currency)][Fiat(b.Fiat)], URL(b.URL))
+	c.remove(b)
 
 	return nil
 }
+
+func (c *Cache) remove(b ConditionBlock) {
+	delete(c.index, ID(b.ID))
+
+	ids := c.subscribers[Token(b.Currency)][Fiat(b.Fiat)]
+	delete(ids, ID(b.ID))
+	if len(ids) == 0 {
+		delete(c.subscribers[Token(b.Currency)], Fiat(b.Fiat))
+	}
+	if len(c.subscribers[Token(b.Currency)]) == 0 {
+		delete(c.subscribers, Token(b.Currency))
+	}
+}
+
+func (c *Cache) Find(id string) (ConditionBlock, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	b, ok := c.index[ID(id)]
+	return b, ok
+}
+
+func (c *Cache) FindByURL(url string) []ConditionBlock {
+	c.Lock()
+	defer c.Unlock()
+
+	blocks := make([]ConditionBlock, 0)
+	for _, b := range c.index {
+		if b.URL == url {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+func (c *Cache) FindByOwner(owner string) []ConditionBlock {
+	c.Lock()
+	defer c.Unlock()
+
+	blocks := make([]ConditionBlock, 0)
+	for _, b := range c.index {
+		if b.Owner == owner {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+func (c *Cache) Close() error {
+	return nil
+}
+
+// Len returns how many blocks are stored.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.index)
+}
+
+func (c *Cache) All() []ConditionBlock {
+	c.Lock()
+	defer c.Unlock()
+
+	blocks := make([]ConditionBlock, 0, len(c.index))
+	for _, b := range c.index {
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
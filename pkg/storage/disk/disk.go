@@ -0,0 +1,184 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/file"
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	"github.com/pkg/errors"
+)
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+
+	// the journal is rewritten once it holds this many records more
+	// than there are subscriptions, every update of a block adds one
+	compactAfter = 1000
+)
+
+type record struct {
+	Op    string                `json:"op"`
+	ID    string                `json:"id,omitempty"`
+	Block *cache.ConditionBlock `json:"block,omitempty"`
+}
+
+// Store keeps subscriptions in memory and mirrors every change
+// to an append-only journal, which is replayed by Open and compacted
+// when it grows too long.
+type Store struct {
+	*cache.Cache
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	records int
+}
+
+func Open(path string) (*Store, error) {
+	s := Store{
+		Cache: cache.NewCache(),
+		path:  path,
+	}
+	if err := s.replay(); err != nil {
+		return nil, errors.Wrap(err, "journal replay")
+	}
+	if err := s.compact(); err != nil {
+		return nil, errors.Wrap(err, "journal compaction")
+	}
+
+	return &s, nil
+}
+
+func (s *Store) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var (
+		line int
+		torn error
+	)
+	for scanner.Scan() {
+		line++
+		// only the last line may be torn by a crash during a write, a
+		// bad line before it means the journal is corrupt
+		if torn != nil {
+			return torn
+		}
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			torn = errors.Wrapf(err, "journal line %d", line)
+			continue
+		}
+		switch r.Op {
+		case opSet:
+			if r.Block != nil {
+				_ = s.Cache.Set(*r.Block)
+			}
+		case opDelete:
+			_ = s.Cache.Delete(r.ID)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal so it holds only the live subscriptions
+// and reopens it for appending, it must be called with s.mu held.
+func (s *Store) compact() error {
+	err := file.Replace(s.path, func(w io.Writer) error {
+		for _, b := range s.Cache.All() {
+			b := b
+			if err := writeRecord(w, record{Op: opSet, Block: &b}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "journal open")
+	}
+	if s.f != nil {
+		// the old journal was renamed over, nothing is lost with it
+		s.f.Close()
+	}
+	s.f = f
+	s.records = s.Cache.Len()
+	return nil
+}
+
+func (s *Store) Set(b cache.ConditionBlock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(record{Op: opSet, Block: &b}); err != nil {
+		return err
+	}
+	if err := s.Cache.Set(b); err != nil {
+		return err
+	}
+	return s.compactIfLong()
+}
+
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Cache.Find(id); !ok {
+		return errors.New("no key in map")
+	}
+	if err := s.append(record{Op: opDelete, ID: id}); err != nil {
+		return err
+	}
+	if err := s.Cache.Delete(id); err != nil {
+		return err
+	}
+	return s.compactIfLong()
+}
+
+// compactIfLong compacts the journal once it holds compactAfter records
+// more than there are subscriptions, it must be called with s.mu held.
+func (s *Store) compactIfLong() error {
+	if s.records <= s.Cache.Len()+compactAfter {
+		return nil
+	}
+	return errors.Wrap(s.compact(), "journal compaction")
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+func (s *Store) append(r record) error {
+	if err := writeRecord(s.f, r); err != nil {
+		return errors.Wrap(err, "journal write")
+	}
+	s.records++
+	return s.f.Sync()
+}
+
+func writeRecord(w io.Writer, r record) error {
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,173 @@
+package receiver
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	"github.com/pkg/errors"
+)
+
+const (
+	percentUp   = "+%"
+	percentDown = "-%"
+	percentMove = "±%"
+
+	crossesAbove = "crosses_above"
+	crossesBelow = "crosses_below"
+
+	approxEqual = "~="
+)
+
+// defaultTolerance is the percent of the condition price within which
+// "~=" fires when the block has no tolerance of its own.
+const defaultTolerance = "0.1"
+
+var hundred = big.NewRat(100, 1)
+
+func isPercent(condition string) bool {
+	return condition == percentUp || condition == percentDown || condition == percentMove
+}
+
+// tick is a polled price together with the one polled before it.
+type tick struct {
+	price       string
+	previous    *big.Rat
+	hasPrevious bool
+	at          time.Time
+}
+
+func (r *Receiver) triggered(block cache.ConditionBlock, t tick) (bool, error) {
+	if isPercent(block.Condition) {
+		return r.percentChanged(block, t.price, t.at)
+	}
+	if block.Condition == crossesAbove || block.Condition == crossesBelow {
+		return crossed(block, t)
+	}
+	if block.Condition == approxEqual {
+		return approximately(block, t.price)
+	}
+
+	parsed, err := parseDecimal(t.price, block.Price)
+	if err != nil {
+		return false, err
+	}
+
+	cmp := parsed[0].Cmp(parsed[1])
+	switch block.Condition {
+	case "==":
+		return cmp == 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<":
+		return cmp < 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	}
+	return false, errors.Wrapf(errMalformed, "unknown condition %q", block.Condition)
+}
+
+// approximately fires when the price is within the tolerance percent
+// of the condition price.
+func approximately(block cache.ConditionBlock, price string) (bool, error) {
+	tolerance := block.Tolerance
+	if tolerance == "" {
+		tolerance = defaultTolerance
+	}
+	parsed, err := parseDecimal(price, block.Price, tolerance)
+	if err != nil {
+		return false, err
+	}
+	current, target, percent := parsed[0], parsed[1], parsed[2]
+
+	diff := new(big.Rat).Sub(current, target)
+	band := new(big.Rat).Mul(target, percent)
+	band.Quo(band, hundred)
+	return diff.Abs(diff).Cmp(band.Abs(band)) <= 0, nil
+}
+
+// percentChanged compares the price either with the baseline captured
+// at subscription time or, when the block has a window, with the
+// lowest and highest prices seen within it.
+func (r *Receiver) percentChanged(block cache.ConditionBlock, price string, now time.Time) (bool, error) {
+	parsed, err := parseDecimal(price, block.Price)
+	if err != nil {
+		return false, err
+	}
+	current, percent := parsed[0], parsed[1]
+
+	if block.Window != "" {
+		window, err := time.ParseDuration(block.Window)
+		if err != nil {
+			return false, errors.Wrap(errMalformed, err.Error())
+		}
+		low, high, ok := r.history.extremes(block.Currency, block.Fiat, now.Add(-window))
+		if !ok {
+			return false, nil
+		}
+		return percentReached(block.Condition, current, low, high, percent), nil
+	}
+
+	if block.BasePrice == "" {
+		block.BasePrice = price
+		return false, r.save(block)
+	}
+	base, err := parseDecimal(block.BasePrice)
+	if err != nil {
+		return false, err
+	}
+	return percentReached(block.Condition, current, base[0], base[0], percent), nil
+}
+
+// crossed reports whether the threshold lies between the previous
+// and the current price, so an alert never fires on the first tick.
+func crossed(block cache.ConditionBlock, t tick) (bool, error) {
+	if !t.hasPrevious {
+		return false, nil
+	}
+	parsed, err := parseDecimal(t.price, block.Price)
+	if err != nil {
+		return false, err
+	}
+	current, threshold := parsed[0], parsed[1]
+
+	switch block.Condition {
+	case crossesAbove:
+		return t.previous.Cmp(threshold) < 0 && current.Cmp(threshold) >= 0, nil
+	case crossesBelow:
+		return t.previous.Cmp(threshold) > 0 && current.Cmp(threshold) <= 0, nil
+	}
+	return false, nil
+}
+
+func percentReached(condition string, current, low, high, percent *big.Rat) bool {
+	up := low.Sign() > 0 && percentOf(new(big.Rat).Sub(current, low), low).Cmp(percent) >= 0
+	down := high.Sign() > 0 && percentOf(new(big.Rat).Sub(high, current), high).Cmp(percent) >= 0
+
+	switch condition {
+	case percentUp:
+		return up
+	case percentDown:
+		return down
+	case percentMove:
+		return up || down
+	}
+	return false
+}
+
+// percentOf returns part / base * 100.
+func percentOf(part, base *big.Rat) *big.Rat {
+	p := new(big.Rat).Quo(part, base)
+	return p.Mul(p, hundred)
+}
+
+func (r *Receiver) captureBasePrice(block *cache.ConditionBlock) {
+	if !isPercent(block.Condition) || block.Window != "" || block.BasePrice != "" {
+		return
+	}
+	if s, ok := r.history.last(block.Currency, block.Fiat); ok {
+		block.BasePrice = s.raw
+	}
+}
@@ -5,36 +5,183 @@ import (
 	"github.com/button-tech/utils-rate-alerts/pkg/respond"
 	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
 	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/pkg/errors"
 	"github.com/qiangxue/fasthttp-routing"
 	"github.com/valyala/fasthttp"
 	"net/http"
 )
 
 type controller struct {
-	store *cache.Cache
+	store cache.Store
+	r     *Receiver
 }
 
+// deleteFromProcessing is the admin fallback for deleting an alert, the
+// deletion is published so the receiver that owns the token drops it too.
 func (c *controller) deleteFromProcessing(ctx *routing.Context) error {
 	var b cache.ConditionBlock
 	if err := json.Unmarshal(ctx.PostBody(), &b); err != nil {
-		return err
+		return routing.NewHTTPError(fasthttp.StatusBadRequest, err.Error())
 	}
 
-	if err := c.store.Delete(b); err != nil {
+	stored, ok := c.store.Find(b.ID)
+	if !ok {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "alert not found")
+	}
+	if err := c.r.remove(stored); err != nil {
 		return err
 	}
 	respond.WithJSON(ctx, fasthttp.StatusCreated, t.Payload{"result": "ok"})
 	return nil
 }
 
+// alerts lists the blocks of a url or of an owner, with both given only
+// the blocks of the owner with that url.
+func (c *controller) alerts(ctx *routing.Context) error {
+	url := string(ctx.QueryArgs().Peek("url"))
+	owner, byOwner, err := ownerArg(ctx)
+	if err != nil {
+		return err
+	}
+
+	var blocks []cache.ConditionBlock
+	switch {
+	case byOwner:
+		blocks, _ = c.r.Alerts(owner, url)
+	case url != "":
+		blocks = c.store.FindByURL(url)
+	default:
+		return routing.NewHTTPError(fasthttp.StatusBadRequest, "url or owner is required")
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": blocks})
+	return nil
+}
+
+// Alerts returns the alerts of the owner, only those of url when it
+// isn't empty. The api of the all-in-one binary calls it directly.
+func (r *Receiver) Alerts(owner, url string) ([]cache.ConditionBlock, error) {
+	if owner == "" {
+		return nil, errors.New("owner is required")
+	}
+	blocks := r.store.FindByOwner(owner)
+	if url != "" {
+		blocks = filterURL(blocks, url)
+	}
+	return blocks, nil
+}
+
+// Alert returns the alert with the id when it belongs to the owner.
+func (r *Receiver) Alert(id, owner string) (cache.ConditionBlock, bool, error) {
+	b, ok := r.store.Find(id)
+	if !ok || b.Owner != owner {
+		return cache.ConditionBlock{}, false, nil
+	}
+	return b, true, nil
+}
+
+func filterURL(blocks []cache.ConditionBlock, url string) []cache.ConditionBlock {
+	filtered := make([]cache.ConditionBlock, 0, len(blocks))
+	for _, b := range blocks {
+		if b.URL == url {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
+// alertByID answers 404 for the blocks of another owner, when one is given.
+func (c *controller) alertByID(ctx *routing.Context) error {
+	owner, byOwner, err := ownerArg(ctx)
+	if err != nil {
+		return err
+	}
+	b, ok := c.store.Find(ctx.Param("id"))
+	if byOwner {
+		b, ok, _ = c.r.Alert(ctx.Param("id"), owner)
+	}
+	if !ok {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "alert not found")
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": b})
+	return nil
+}
+
+// ownerArg reads the owner the api asks on behalf of. The api always
+// sends exactly one, so an empty or repeated owner is refused rather
+// than taken for no owner at all.
+func ownerArg(ctx *routing.Context) (string, bool, error) {
+	owners := ctx.QueryArgs().PeekMulti("owner")
+	switch {
+	case len(owners) == 0:
+		return "", false, nil
+	case len(owners) > 1 || len(owners[0]) == 0:
+		return "", true, routing.NewHTTPError(fasthttp.StatusBadRequest, "exactly one non-empty owner is required")
+	}
+	return string(owners[0]), true, nil
+}
+
+func (c *controller) deadLetters(ctx *routing.Context) error {
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": c.r.deadLetters.list()})
+	return nil
+}
+
+func (c *controller) retryDeadLetter(ctx *routing.Context) error {
+	if _, ok := c.r.deadLetters.get(ctx.Param("id")); !ok {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "dead letter not found")
+	}
+
+	l, err := c.r.retryDeadLetter(ctx.Param("id"))
+	if err != nil {
+		respond.WithJSON(ctx, fasthttp.StatusBadGateway, t.Payload{"error": err.Error(), "result": l})
+		return nil
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": "delivered"})
+	return nil
+}
+
+func (c *controller) discardDeadLetter(ctx *routing.Context) error {
+	if err := c.r.deadLetters.remove(ctx.Param("id")); err != nil {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "dead letter not found")
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": "ok"})
+	return nil
+}
+
+func (c *controller) quarantine(ctx *routing.Context) error {
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": c.r.quarantined()})
+	return nil
+}
+
+func (c *controller) releaseQuarantine(ctx *routing.Context) error {
+	b, err := c.r.release(ctx.Param("id"))
+	if err != nil {
+		return routing.NewHTTPError(fasthttp.StatusNotFound, "alert not quarantined")
+	}
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": b})
+	return nil
+}
+
+func (c *controller) deliveries(ctx *routing.Context) error {
+	respond.WithJSON(ctx, fasthttp.StatusOK, t.Payload{"result": c.r.pool.results()})
+	return nil
+}
+
 func (r *Receiver) mount() {
 	r.g.Post("/delete", r.c.deleteFromProcessing)
+	r.g.Get("/alerts", r.c.alerts)
+	r.g.Get("/alerts/<id>", r.c.alertByID)
+	r.g.Get("/deliveries", r.c.deliveries)
+	r.g.Get("/dead-letters", r.c.deadLetters)
+	r.g.Post("/dead-letters/<id>/retry", r.c.retryDeadLetter)
+	r.g.Delete("/dead-letters/<id>", r.c.discardDeadLetter)
+	r.g.Get("/quarantine", r.c.quarantine)
+	r.g.Post("/quarantine/<id>/release", r.c.releaseQuarantine)
 }
 
 func cors(ctx *routing.Context) error {
 	ctx.Response.Header.Set("Access-Control-Allow-Origin", string(ctx.Request.Header.Peek("Origin")))
 	ctx.Response.Header.Set("Access-Control-Allow-Credentials", "false")
-	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET,HEAD,PUT,POST,DELETE")
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET,HEAD,PUT,PATCH,POST,DELETE")
 	ctx.Response.Header.Set(
 		"Access-Control-Allow-Headers",
 		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization",
@@ -0,0 +1,120 @@
+package receiver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is a triggered alert whose notification was not accepted.
+type DeadLetter struct {
+	ID         string               `json:"id"`
+	Block      cache.ConditionBlock `json:"block"`
+	URL        string               `json:"url"`
+	Reason     string               `json:"reason"`
+	Retries    int                  `json:"retries"`
+	LastStatus int                  `json:"lastStatus"`
+	FailedAt   int64                `json:"failedAt"`
+}
+
+// deadLetters keeps undeliverable notifications in a JSON file
+// until they are retried or discarded.
+type deadLetters struct {
+	mu      sync.Mutex
+	path    string
+	letters map[string]DeadLetter
+}
+
+func openDeadLetters(path string) (*deadLetters, error) {
+	d := deadLetters{
+		path:    path,
+		letters: make(map[string]DeadLetter),
+	}
+
+	var letters []DeadLetter
+	if err := loadJSON(path, &letters); err != nil {
+		return nil, err
+	}
+	for _, l := range letters {
+		d.letters[l.ID] = l
+	}
+	return &d, nil
+}
+
+func (d *deadLetters) add(l DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if l.ID == "" {
+		l.ID = t.NewID()
+	}
+	l.FailedAt = time.Now().Unix()
+	d.letters[l.ID] = l
+	return d.save()
+}
+
+func (d *deadLetters) list() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	letters := make([]DeadLetter, 0, len(d.letters))
+	for _, l := range d.letters {
+		letters = append(letters, l)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt < letters[j].FailedAt
+	})
+	return letters
+}
+
+func (d *deadLetters) get(id string) (DeadLetter, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	l, ok := d.letters[id]
+	return l, ok
+}
+
+func (d *deadLetters) remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.letters[id]; !ok {
+		return errors.New("no dead letter")
+	}
+	delete(d.letters, id)
+	return d.save()
+}
+
+// save must be called with d.mu held.
+func (d *deadLetters) save() error {
+	letters := make([]DeadLetter, 0, len(d.letters))
+	for _, l := range d.letters {
+		letters = append(letters, l)
+	}
+	return saveJSON(d.path, letters)
+}
+
+func (r *Receiver) retryDeadLetter(id string) (DeadLetter, error) {
+	l, ok := r.deadLetters.get(id)
+	if !ok {
+		return l, errors.New("no dead letter")
+	}
+
+	status, err := r.notify(l.Block, l.URL)
+	if err == nil {
+		return l, r.deadLetters.remove(id)
+	}
+
+	l.Retries++
+	l.LastStatus = status
+	l.Reason = err.Error()
+	if err := r.deadLetters.add(l); err != nil {
+		return l, err
+	}
+	return l, err
+}
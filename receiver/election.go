@@ -0,0 +1,63 @@
+package receiver
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+)
+
+const (
+	modeShard  = "shard"
+	modeLeader = "leader"
+
+	// well below the polling interval, so a standby takes over before
+	// the next poll is missed
+	leaseRetry = 10 * time.Second
+)
+
+// lease tells whether this receiver leads, in leader mode only the
+// leader polls the prices and evaluates the subscriptions, the standby
+// ones keep their copy of them warm.
+type lease struct {
+	mu      sync.Mutex
+	leading bool
+}
+
+func (l *lease) set(leading bool) {
+	l.mu.Lock()
+	l.leading = leading
+	l.mu.Unlock()
+}
+
+func (l *lease) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// Election tries to take the lease until the process stops, it does
+// nothing unless RECEIVER_MODE is leader.
+func (r *Receiver) Election() {
+	if r.mode != modeLeader {
+		return
+	}
+
+	ticker := time.NewTicker(leaseRetry)
+	for ; ; <-ticker.C {
+		lost, err := r.broker.Lease()
+		if err != nil {
+			if err != broker.ErrLeaseHeld {
+				log.Println(err)
+			}
+			continue
+		}
+
+		log.Println("receiver leads:", r.members.self)
+		r.lease.set(true)
+		<-lost
+		r.lease.set(false)
+		log.Println("receiver lost the lease:", r.members.self)
+	}
+}
@@ -0,0 +1,65 @@
+package receiver
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FakeProvider serves prices set by hand, for tests and local runs.
+type FakeProvider struct {
+	mu     sync.Mutex
+	prices map[string]map[string]string
+	err    error
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		prices: make(map[string]map[string]string),
+	}
+}
+
+func (fp *FakeProvider) Set(token, fiat, price string) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if _, ok := fp.prices[fiat]; !ok {
+		fp.prices[fiat] = make(map[string]string)
+	}
+	fp.prices[fiat][token] = price
+}
+
+// Fail makes every following call return err, nil restores the prices.
+func (fp *FakeProvider) Fail(err error) {
+	fp.mu.Lock()
+	fp.err = err
+	fp.mu.Unlock()
+}
+
+func (fp *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (fp *FakeProvider) Prices(tokens, currencies []string) ([]*Prices, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.err != nil {
+		return nil, fp.err
+	}
+
+	pp := make([]*Prices, 0, len(currencies))
+	for _, c := range currencies {
+		p := Prices{Currency: c, Rates: make(map[string]string)}
+		for _, tk := range tokens {
+			if price, ok := fp.prices[c][tk]; ok {
+				p.Rates[tk] = price
+			}
+		}
+		pp = append(pp, &p)
+	}
+	if len(pp) == 0 {
+		return nil, errors.New("fake provider: no currencies requested")
+	}
+	return pp, nil
+}
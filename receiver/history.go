@@ -0,0 +1,79 @@
+package receiver
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+const historyRetention = 24 * time.Hour
+
+type sample struct {
+	at    time.Time
+	price *big.Rat
+	raw   string
+}
+
+type history struct {
+	sync.Mutex
+	samples map[string][]sample
+}
+
+func newHistory() *history {
+	return &history{
+		samples: make(map[string][]sample),
+	}
+}
+
+func pairKey(token, fiat string) string {
+	return token + "_" + fiat
+}
+
+func (h *history) add(token, fiat string, price *big.Rat, raw string, at time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	k := pairKey(token, fiat)
+	ss := append(h.samples[k], sample{at: at, price: price, raw: raw})
+
+	border := at.Add(-historyRetention)
+	i := 0
+	for i < len(ss) && ss[i].at.Before(border) {
+		i++
+	}
+	h.samples[k] = ss[i:]
+}
+
+func (h *history) last(token, fiat string) (sample, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	ss := h.samples[pairKey(token, fiat)]
+	if len(ss) == 0 {
+		return sample{}, false
+	}
+	return ss[len(ss)-1], true
+}
+
+// extremes returns the lowest and the highest price seen since the given time.
+func (h *history) extremes(token, fiat string, since time.Time) (min, max *big.Rat, ok bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, s := range h.samples[pairKey(token, fiat)] {
+		if s.at.Before(since) {
+			continue
+		}
+		if !ok {
+			min, max, ok = s.price, s.price, true
+			continue
+		}
+		if s.price.Cmp(min) < 0 {
+			min = s.price
+		}
+		if s.price.Cmp(max) > 0 {
+			max = s.price
+		}
+	}
+	return
+}
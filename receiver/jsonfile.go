@@ -0,0 +1,34 @@
+package receiver
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/file"
+)
+
+// loadJSON reads v from path, a missing file leaves v untouched.
+func loadJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON replaces the file at path with v in one rename.
+func saveJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return file.Replace(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
@@ -0,0 +1,216 @@
+package receiver
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+)
+
+const (
+	heartbeatEvery = 5 * time.Second
+	memberTimeout  = 3 * heartbeatEvery
+)
+
+type heartbeat struct {
+	ID string `json:"id"`
+}
+
+// members tracks the receivers that sent a heartbeat lately. Each token
+// belongs to one of them, picked by rendezvous hashing, so when one
+// leaves only its tokens move to the others.
+type members struct {
+	self  string
+	start time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newMembers(self string) *members {
+	return &members{
+		self:  self,
+		start: time.Now(),
+		seen:  make(map[string]time.Time),
+	}
+}
+
+// beat records a heartbeat and reports whether the receiver is new.
+func (m *members) beat(id string, at time.Time) bool {
+	if id == m.self {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := m.seen[id]
+	m.seen[id] = at
+	return !ok || at.Sub(last) > memberTimeout
+}
+
+func (m *members) leave(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.seen, id)
+}
+
+// alive returns the receivers, this one included, sorted by id.
+func (m *members) alive(now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := []string{m.self}
+	for id, at := range m.seen {
+		if now.Sub(at) <= memberTimeout {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// settled is false until the heartbeats of the others had time to
+// arrive, before that this receiver can't tell which tokens are its own.
+func (m *members) settled(now time.Time) bool {
+	return now.Sub(m.start) > memberTimeout
+}
+
+func owner(token string, ids []string) string {
+	var (
+		best  string
+		score uint64
+	)
+	for _, id := range ids {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+		h.Write([]byte(token))
+		if s := h.Sum64(); best == "" || s > score {
+			best, score = id, s
+		}
+	}
+	return best
+}
+
+func (r *Receiver) owns(token string) bool {
+	if r.mode == modeLeader {
+		return r.lease.held()
+	}
+
+	now := time.Now()
+	if !r.members.settled(now) {
+		return false
+	}
+	return owner(token, r.members.alive(now)) == r.members.self
+}
+
+// Membership announces this receiver to the others and follows their
+// heartbeats until the process stops.
+func (r *Receiver) Membership() {
+	c, err := r.broker.ConsumeMembership()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go r.heartbeats()
+
+	for msg := range c {
+		var hb heartbeat
+		if err := json.Unmarshal(msg.Body, &hb); err != nil {
+			log.Println(err)
+		} else if msg.Event == broker.Left {
+			r.members.leave(hb.ID)
+		} else {
+			before := r.members.alive(time.Now())
+			if r.members.beat(hb.ID, time.Now()) {
+				log.Println("receiver joined:", hb.ID)
+				go r.handover(before)
+			}
+		}
+		if err := msg.Ack(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (r *Receiver) heartbeats() {
+	<-r.listening
+	ticker := time.NewTicker(heartbeatEvery)
+	for ; ; <-ticker.C {
+		if err := r.announce(broker.Heartbeat); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (r *Receiver) announce(event string) error {
+	body, err := json.Marshal(heartbeat{ID: r.members.self})
+	if err != nil {
+		return err
+	}
+	return r.broker.Publish(event, body)
+}
+
+// handover sends the subscriptions this receiver owned among ids to
+// everybody, so a receiver that just joined has all of them. In leader
+// mode the leader owns them all.
+func (r *Receiver) handover(ids []string) {
+	if r.mode == modeLeader {
+		if !r.lease.held() {
+			return
+		}
+		ids = []string{r.members.self}
+	}
+
+	for token, fiats := range r.store.Get() {
+		if owner(string(token), ids) != r.members.self {
+			continue
+		}
+		for _, blocks := range fiats {
+			for _, block := range blocks {
+				if err := r.sync(block); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// save and remove change a subscription this receiver owns and tell the
+// other receivers, which keep a copy in case they take it over.
+func (r *Receiver) save(block cache.ConditionBlock) error {
+	if err := r.store.Set(block); err != nil {
+		return err
+	}
+	if err := r.sync(block); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (r *Receiver) remove(block cache.ConditionBlock) error {
+	if err := r.store.Delete(block.ID); err != nil {
+		return err
+	}
+	body, err := json.Marshal(cache.ConditionBlock{ID: block.ID, Owner: block.Owner})
+	if err != nil {
+		return err
+	}
+	if err := r.broker.Publish(broker.Deleted, body); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (r *Receiver) sync(block cache.ConditionBlock) error {
+	body, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return r.broker.Publish(broker.Synced, body)
+}
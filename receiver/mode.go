@@ -0,0 +1,82 @@
+package receiver
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/pkg/errors"
+)
+
+// armed reports whether a recurring block may fire on this tick: its
+// cooldown is over and, after the last notification, the price has
+// moved back across the threshold by the hysteresis percent.
+func (r *Receiver) armed(block cache.ConditionBlock, tk tick) (bool, error) {
+	if block.Mode != t.ModeRecurring {
+		return true, nil
+	}
+
+	if block.Cooldown != "" && block.FiredAt != 0 {
+		cooldown, err := time.ParseDuration(block.Cooldown)
+		if err != nil {
+			return false, errors.Wrap(errMalformed, err.Error())
+		}
+		if tk.at.Before(time.Unix(block.FiredAt, 0).Add(cooldown)) {
+			return false, nil
+		}
+	}
+
+	if !block.Disarmed {
+		return true, nil
+	}
+
+	ok, err := rearmed(block, tk.price)
+	if err != nil || !ok {
+		return false, err
+	}
+	block.Disarmed = false
+	return true, r.save(block)
+}
+
+func rearmed(block cache.ConditionBlock, price string) (bool, error) {
+	parsed, err := parseDecimal(price, block.Price, block.Hysteresis)
+	if err != nil {
+		return false, err
+	}
+	current, threshold, hysteresis := parsed[0], parsed[1], parsed[2]
+
+	band := new(big.Rat).Mul(threshold, hysteresis)
+	band.Quo(band, hundred)
+
+	switch block.Condition {
+	case ">", ">=", crossesAbove:
+		return current.Cmp(new(big.Rat).Sub(threshold, band)) <= 0, nil
+	case "<", "<=", crossesBelow:
+		return current.Cmp(new(big.Rat).Add(threshold, band)) >= 0, nil
+	}
+	diff := new(big.Rat).Sub(current, threshold)
+	return diff.Abs(diff).Cmp(band) >= 0, nil
+}
+
+// complete is called once the notification is delivered: one-shot
+// blocks are removed, recurring ones start their cooldown.
+func (r *Receiver) complete(block cache.ConditionBlock) error {
+	if block.Mode != t.ModeRecurring {
+		return r.remove(block)
+	}
+
+	stored, ok := r.store.Find(block.ID)
+	if !ok {
+		return nil
+	}
+	stored.FiredAt = time.Now().Unix()
+	if isPercent(stored.Condition) {
+		if stored.Window == "" {
+			stored.BasePrice = block.CurrentPrice
+		}
+	} else {
+		stored.Disarmed = stored.Hysteresis != ""
+	}
+	return r.save(stored)
+}
@@ -0,0 +1,344 @@
+package receiver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/file"
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	baseBackoff     = 3 * time.Second
+	maxBackoff      = 10 * time.Minute
+	maxAttempts     = 10
+	outboxPollEvery = time.Second
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// notification is a triggered alert waiting in the outbox.
+type notification struct {
+	ID          string               `json:"id"`
+	Block       cache.ConditionBlock `json:"block"`
+	URL         string               `json:"url"`
+	Attempts    int                  `json:"attempts"`
+	NextAttempt int64                `json:"nextAttempt"`
+	LastStatus  int                  `json:"lastStatus"`
+	LastError   string               `json:"lastError"`
+}
+
+const (
+	opPut    = "put"
+	opRemove = "remove"
+
+	// the journal is rewritten once it holds this many records more
+	// than there are notifications waiting
+	compactAfter = 1000
+)
+
+type outboxRecord struct {
+	Op           string        `json:"op"`
+	ID           string        `json:"id,omitempty"`
+	Notification *notification `json:"notification,omitempty"`
+}
+
+// outbox records triggered notifications on disk before they are sent,
+// so they survive a restart and are delivered at least once. Every
+// change is appended to a journal, which is replayed and compacted by
+// openOutbox.
+type outbox struct {
+	mu            sync.Mutex
+	path          string
+	f             *os.File
+	records       int
+	notifications map[string]notification
+	// the notifications a worker is delivering
+	sending map[string]struct{}
+}
+
+func openOutbox(path string) (*outbox, error) {
+	o := outbox{
+		path:          path,
+		notifications: make(map[string]notification),
+		sending:       make(map[string]struct{}),
+	}
+	if err := o.replay(); err != nil {
+		return nil, errors.Wrap(err, "outbox replay")
+	}
+	if err := o.compact(); err != nil {
+		return nil, errors.Wrap(err, "outbox compaction")
+	}
+	return &o, nil
+}
+
+func (o *outbox) replay() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var (
+		line int
+		torn error
+	)
+	for scanner.Scan() {
+		line++
+		if torn != nil {
+			return torn
+		}
+
+		var r outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// only a torn write at the tail is tolerated
+			torn = errors.Wrapf(err, "outbox line %d", line)
+			continue
+		}
+		switch r.Op {
+		case opPut:
+			if r.Notification != nil {
+				o.notifications[r.Notification.ID] = *r.Notification
+			}
+		case opRemove:
+			delete(o.notifications, r.ID)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with the waiting notifications only and
+// reopens it for appending, it must be called with o.mu held.
+func (o *outbox) compact() error {
+	err := file.Replace(o.path, func(w io.Writer) error {
+		for _, n := range o.notifications {
+			n := n
+			if err := writeJSONLine(w, outboxRecord{Op: opPut, Notification: &n}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if o.f != nil {
+		// the old journal was renamed over, nothing is lost with it
+		o.f.Close()
+	}
+	o.f = f
+	o.records = len(o.notifications)
+	return nil
+}
+
+func (o *outbox) put(n notification) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if n.ID == "" {
+		n.ID = t.NewID()
+	}
+	if err := o.append(outboxRecord{Op: opPut, Notification: &n}); err != nil {
+		return err
+	}
+	o.notifications[n.ID] = n
+	return nil
+}
+
+func (o *outbox) remove(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.notifications[id]; !ok {
+		return nil
+	}
+	if err := o.append(outboxRecord{Op: opRemove, ID: id}); err != nil {
+		return err
+	}
+	delete(o.notifications, id)
+
+	if o.records > len(o.notifications)+compactAfter {
+		return o.compact()
+	}
+	return nil
+}
+
+// due returns the notifications whose next attempt has come.
+func (o *outbox) due(now time.Time) []notification {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var ns []notification
+	for _, n := range o.notifications {
+		if n.NextAttempt <= now.UnixNano() {
+			ns = append(ns, n)
+		}
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return ns[i].NextAttempt < ns[j].NextAttempt
+	})
+	return ns
+}
+
+// claim returns the notification as it is stored now and marks it as
+// being sent, it fails when the notification is gone, is already being
+// sent or isn't due any more. Every claim is ended by unclaim.
+func (o *outbox) claim(id string, now time.Time) (notification, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n, ok := o.notifications[id]
+	if !ok || n.NextAttempt > now.UnixNano() {
+		return n, false
+	}
+	if _, ok := o.sending[id]; ok {
+		return n, false
+	}
+	o.sending[id] = struct{}{}
+	return n, true
+}
+
+func (o *outbox) unclaim(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.sending, id)
+}
+
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+// append must be called with o.mu held.
+func (o *outbox) append(r outboxRecord) error {
+	if o.f == nil {
+		return errors.New("outbox journal is not open")
+	}
+	if err := writeJSONLine(o.f, r); err != nil {
+		return errors.Wrap(err, "outbox write")
+	}
+	o.records++
+	return o.f.Sync()
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// backoff doubles the delay with every attempt and picks a random
+// point in its upper half, so retries of one host spread out.
+func backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *Receiver) enqueue(block cache.ConditionBlock) error {
+	return r.outbox.put(notification{
+		Block:       block,
+		URL:         makeURL(block),
+		NextAttempt: time.Now().UnixNano(),
+	})
+}
+
+// Deliver hands the due notifications from the outbox to the worker
+// pool until the process stops.
+func (r *Receiver) Deliver() {
+	ticker := time.NewTicker(outboxPollEvery)
+	for ; ; <-ticker.C {
+		for _, due := range r.outbox.due(time.Now()) {
+			// a worker may have sent it since due was read
+			n, ok := r.outbox.claim(due.ID, time.Now())
+			if !ok {
+				continue
+			}
+			if !r.pool.dispatch(n) {
+				r.outbox.unclaim(n.ID)
+			}
+		}
+	}
+}
+
+// deliver sends a notification claimed from the outbox.
+func (r *Receiver) deliver(n notification) deliveryResult {
+	defer r.outbox.unclaim(n.ID)
+
+	start := time.Now()
+	status, err := r.notify(n.Block, n.URL)
+
+	n.Attempts++
+	res := deliveryResult{
+		BlockID:        n.Block.ID,
+		NotificationID: n.ID,
+		URL:            n.URL,
+		Attempt:        n.Attempts,
+		Status:         status,
+		Duration:       since(start),
+		At:             start.Unix(),
+	}
+	if err == nil {
+		if err := r.outbox.remove(n.ID); err != nil {
+			log.Println(err)
+		}
+		return res
+	}
+	res.Error = err.Error()
+
+	n.LastStatus = status
+	n.LastError = err.Error()
+	if n.Attempts < maxAttempts && errors.Cause(err) != errForbiddenURL {
+		n.NextAttempt = time.Now().Add(backoff(n.Attempts)).UnixNano()
+		if err := r.outbox.put(n); err != nil {
+			log.Println(err)
+		}
+		return res
+	}
+
+	if err := r.deadLetters.add(DeadLetter{
+		Block:      n.Block,
+		URL:        n.URL,
+		Reason:     n.LastError,
+		Retries:    n.Attempts,
+		LastStatus: n.LastStatus,
+	}); err != nil {
+		log.Println(err)
+		return res
+	}
+	if err := r.outbox.remove(n.ID); err != nil {
+		log.Println(err)
+	}
+	res.DeadLettered = true
+	return res
+}
@@ -0,0 +1,124 @@
+package receiver
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers = 16
+	defaultPerHost = 4
+	reportSize     = 500
+)
+
+// deliveryResult is the outcome of one delivery attempt of a block.
+type deliveryResult struct {
+	BlockID        string `json:"blockId"`
+	NotificationID string `json:"notificationId"`
+	URL            string `json:"url"`
+	Attempt        int    `json:"attempt"`
+	Status         int    `json:"status"`
+	Error          string `json:"error,omitempty"`
+	DeadLettered   bool   `json:"deadLettered,omitempty"`
+	Duration       string `json:"duration"`
+	At             int64  `json:"at"`
+}
+
+// pool runs deliveries on a fixed number of workers and lets no single
+// destination host hold more than perHost of them.
+type pool struct {
+	jobs    chan notification
+	perHost int
+
+	mu     sync.Mutex
+	busy   map[string]int
+	report []deliveryResult
+}
+
+func newPool(workers, perHost int, deliver func(notification) deliveryResult) *pool {
+	p := &pool{
+		jobs:    make(chan notification),
+		perHost: perHost,
+		busy:    make(map[string]int),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for n := range p.jobs {
+				res := deliver(n)
+				p.release(n)
+				p.record(res)
+			}
+		}()
+	}
+	return p
+}
+
+func host(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+// dispatch blocks until a worker takes n, it returns false when the
+// host of n is at the limit.
+func (p *pool) dispatch(n notification) bool {
+	if !p.acquire(n) {
+		return false
+	}
+	p.jobs <- n
+	return true
+}
+
+func (p *pool) acquire(n notification) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := host(n.URL)
+	if p.busy[h] >= p.perHost {
+		return false
+	}
+	p.busy[h]++
+	return true
+}
+
+func (p *pool) release(n notification) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := host(n.URL)
+	p.busy[h]--
+	if p.busy[h] <= 0 {
+		delete(p.busy, h)
+	}
+}
+
+func (p *pool) record(res deliveryResult) {
+	if res.Error != "" {
+		log.Printf("delivery of block %s to %s, attempt %d: %s", res.BlockID, res.URL, res.Attempt, res.Error)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report = append(p.report, res)
+	if len(p.report) > reportSize {
+		p.report = p.report[len(p.report)-reportSize:]
+	}
+}
+
+// results returns the latest delivery results, oldest first.
+func (p *pool) results() []deliveryResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := make([]deliveryResult, len(p.report))
+	copy(res, p.report)
+	return res
+}
+
+func since(start time.Time) string {
+	return time.Since(start).Round(time.Millisecond).String()
+}
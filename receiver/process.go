@@ -3,102 +3,222 @@ package receiver
 import (
 	"encoding/json"
 	"log"
-	"os"
-	"strconv"
+	"math/big"
 	"strings"
 	"time"
 
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
 	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
 	t "github.com/button-tech/utils-rate-alerts/types"
-	"github.com/imroc/req"
 	"github.com/pkg/errors"
-	"github.com/streadway/amqp"
-	"github.com/valyala/fasthttp"
-	"github.com/valyala/fastjson"
-	"golang.org/x/sync/errgroup"
 )
 
 const trueConditionResult = "true"
 
-func (r *Receiver) deliveryChannel() (<-chan amqp.Delivery, error) {
-	msgs, err := r.rabbitMQ.Channel.Consume(
-		r.rabbitMQ.Queue.Name,
-		"",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+func (r *Receiver) Processing() {
+	subscriptions, err := r.broker.ConsumeSubscriptions()
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		return
 	}
-
-	return msgs, nil
-}
-
-func (r *Receiver) Processing() {
-	c, err := r.deliveryChannel()
+	changes, err := r.broker.ConsumeChanges()
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	close(r.listening)
+
+	go r.consume(changes)
+	r.consume(subscriptions)
+	select {}
+}
 
+func (r *Receiver) consume(c <-chan broker.Delivery) {
 	for msg := range c {
-		var block cache.ConditionBlock
-		if err := json.Unmarshal(msg.Body, &block); err != nil {
+		apply, err := r.decode(msg)
+		if err != nil {
+			log.Println(err)
+			if err := msg.DeadLetter(err); err != nil {
+				log.Println(err)
+				nack(msg)
+			}
+			continue
+		}
+		if err := apply(); err != nil {
 			log.Println(err)
+			nack(msg)
 			continue
 		}
-		r.store.Set(block)
+		if err := msg.Ack(); err != nil {
+			log.Println(err)
+		}
 	}
-	select {}
 }
 
-const crc = "crc"
+// decode reads the message and returns the change of the store it asks for.
+func (r *Receiver) decode(msg broker.Delivery) (func() error, error) {
+	switch msg.Event {
+	case broker.Deleted:
+		var block cache.ConditionBlock
+		err := json.Unmarshal(msg.Body, &block)
+		return func() error { return r.deleted(block.ID, block.Owner) }, err
+	case broker.Updated:
+		var patch t.Alert
+		err := json.Unmarshal(msg.Body, &patch)
+		return func() error { return r.updated(patch) }, err
+	case broker.Synced:
+		var block cache.ConditionBlock
+		err := json.Unmarshal(msg.Body, &block)
+		return func() error { return r.synced(block) }, err
+	}
+
+	// messages of the old topology come without an event
+	var block cache.ConditionBlock
+	err := json.Unmarshal(msg.Body, &block)
+	return func() error { return r.created(block) }, err
+}
+
+func (r *Receiver) created(block cache.ConditionBlock) error {
+	if block.ID == "" {
+		block.ID = t.NewID()
+	}
+	if r.tombstones.buried(block.ID, block.Owner, time.Now()) {
+		log.Println("subscription deleted before it came:", block.ID)
+		return nil
+	}
+	r.captureBasePrice(&block)
+	return r.save(block)
+}
+
+// deleted and updated reach every receiver, the ones that don't have
+// the subscription ignore them, as do all for a change by another owner.
+// A deletion may overtake its subscription, it is kept as a tombstone.
+func (r *Receiver) deleted(id, owner string) error {
+	b, ok := r.store.Find(id)
+	if !ok {
+		r.tombstones.add(id, owner, time.Now())
+		return nil
+	}
+	if b.Owner != owner {
+		return nil
+	}
+	return r.store.Delete(id)
+}
+
+func (r *Receiver) synced(block cache.ConditionBlock) error {
+	if r.tombstones.buried(block.ID, block.Owner, time.Now()) {
+		return nil
+	}
+	return r.store.Set(block)
+}
+
+func (r *Receiver) updated(patch t.Alert) error {
+	b, ok := r.store.Find(patch.ID)
+	if !ok || b.Owner != patch.Owner {
+		return nil
+	}
+	return r.store.Set(patchBlock(b, patch))
+}
+
+// patchBlock applies the non-empty fields of the patch to the block, a
+// new pair drops the base price of percent conditions. The fixed block
+// leaves the quarantine. A block made recurring gets the defaults of a
+// new alert and a percent one loses its hysteresis, which the patch
+// can't be checked against.
+func patchBlock(b cache.ConditionBlock, patch t.Alert) cache.ConditionBlock {
+	b.Quarantine = ""
+	b.QuarantinedAt = 0
+	if patch.Currency != "" && patch.Currency != b.Currency {
+		b.Currency = patch.Currency
+		b.BasePrice = ""
+	}
+	if patch.Fiat != "" && patch.Fiat != b.Fiat {
+		b.Fiat = patch.Fiat
+		b.BasePrice = ""
+	}
+	if patch.Price != "" {
+		b.Price = patch.Price
+	}
+	if patch.Condition != "" {
+		b.Condition = patch.Condition
+	}
+	if patch.Tolerance != "" {
+		b.Tolerance = patch.Tolerance
+	}
+	if patch.Window != "" {
+		b.Window = patch.Window
+	}
+	if patch.Mode != "" {
+		b.Mode = patch.Mode
+	}
+	if patch.Cooldown != "" {
+		b.Cooldown = patch.Cooldown
+	}
+	if patch.Hysteresis != "" {
+		b.Hysteresis = patch.Hysteresis
+	}
+	if patch.URL != "" {
+		b.URL = patch.URL
+	}
+
+	if isPercent(b.Condition) {
+		b.Hysteresis = ""
+	}
+	if b.Mode == t.ModeRecurring {
+		if b.Cooldown == "" {
+			b.Cooldown = t.DefaultCooldown
+		}
+		if b.Hysteresis == "" && !isPercent(b.Condition) {
+			b.Hysteresis = t.DefaultHysteresis
+		}
+	}
+	return b
+}
+
+// nack returns the message to the queue, the pause keeps a failing
+// store from spinning on the same message.
+func nack(msg broker.Delivery) {
+	time.Sleep(time.Second)
+	if err := msg.Requeue(); err != nil {
+		log.Println(err)
+	}
+}
 
 func (r *Receiver) GetPrices() {
 	ticker := time.NewTicker(time.Minute * 1)
 	for ; ; <-ticker.C {
-		var blocks t.RequestBlocks
-		blocks.API = crc
-
-		for k := range r.checkMap(&blocks) {
-			blocks.Currencies = append(blocks.Currencies, k)
+		tokens, currencies := r.checkMap()
+		if len(tokens) == 0 {
+			continue
 		}
 
-		if err := r.getPrices(&blocks); err != nil {
+		if err := r.getPrices(tokens, currencies); err != nil {
 			log.Println(err)
 		}
 	}
 }
 
-func (r *Receiver) checkMap(blocks *t.RequestBlocks) map[string]struct{} {
+func (r *Receiver) checkMap() (tokens, currencies []string) {
 	stored := r.store.Get()
 
 	m := make(map[string]struct{})
 	for currency, fiat := range stored {
-		blocks.Tokens = append(blocks.Tokens, string(currency))
+		if !r.owns(string(currency)) {
+			continue
+		}
+		tokens = append(tokens, string(currency))
 		for f := range fiat {
-			if _, ok := m[string(f)]; !ok {
-				m = map[string]struct{}{}
-			}
 			m[string(f)] = struct{}{}
 		}
 	}
-	return m
-}
-
-func (r *Receiver) getPrices(b *t.RequestBlocks) error {
-	resp, err := req.Post(os.Getenv("PRICES"), req.BodyJSON(&b))
-	if err != nil {
-		return err
-	}
-	if resp.Response().StatusCode != fasthttp.StatusOK {
-		return errors.Wrap(errors.New("No http statusOK"), "responseStatusCode")
+	for f := range m {
+		currencies = append(currencies, f)
 	}
+	return
+}
 
-	gotPrices, err := respFastJSON(resp.Bytes())
+func (r *Receiver) getPrices(tokens, currencies []string) error {
+	gotPrices, err := r.prices.Prices(tokens, currencies)
 	if err != nil {
 		return err
 	}
@@ -110,91 +230,36 @@ func (r *Receiver) getPrices(b *t.RequestBlocks) error {
 	return nil
 }
 
-type parsedPrices struct {
-	currency string
-	rates    map[string]string
-}
-
-const (
-	currency = "currency"
-	rates    = "rates"
-)
-
-func respFastJSON(b []byte) ([]*parsedPrices, error) {
-	var p fastjson.Parser
-	parsed, err := p.ParseBytes(b)
-	if err != nil {
-		return nil, errors.Wrap(err, "parseBytes")
-	}
-
-	var pp []*parsedPrices
-
-	o := parsed.GetObject()
-	data := o.Get("data")
-	array, err := data.Array()
-	if err != nil {
-		return nil, errors.Wrap(err, "can't get array")
-	}
-	for _, v := range array {
-		obj, err := v.Object()
-		if err != nil {
-			return nil, errors.Wrap(err, "can't get object")
-		}
-
-		var p parsedPrices
-		m := make(map[string]string)
-		obj.Visit(func(key []byte, v *fastjson.Value) {
-			sKey := string(key)
-			if sKey == currency {
-				p.currency = trim(v.String())
-			}
-
-			if sKey == rates {
-				rates, _ := v.Array()
-				for _, rate := range rates {
-					rateObj, _ := rate.Object()
-					rateObj.Visit(func(key []byte, v *fastjson.Value) {
-						m[string(key)] = trim(v.String())
-					})
-				}
-				p.rates = m
-			}
-		})
-		pp = append(pp, &p)
-	}
-
-	return pp, nil
-}
-
-func trim(s string) string {
-	trimmed := strings.TrimPrefix(s, "\"")
-	trimmed = strings.TrimSuffix(trimmed, "\"")
-	return trimmed
-}
-
-func (r *Receiver) schedule(pp []*parsedPrices) error {
+func (r *Receiver) schedule(pp []*Prices) error {
 	stored := r.store.Get()
 	if stored == nil {
 		return errors.New("store is nil")
 	}
 
+	now := time.Now()
 	var requests []cache.ConditionBlock
 	for _, p := range pp {
-		for token, price := range p.rates {
-			urlMap := stored[cache.Token(token)][cache.Fiat(p.currency)]
-			for _, block := range urlMap {
-				parsedFloats, err := parseFloat(price, block.Price)
+		for token, price := range p.Rates {
+			current, err := parseDecimal(price)
+			if err != nil {
+				log.Printf("price of %s in %s: %s", token, p.Currency, err)
+				continue
+			}
+			previous, hasPrevious := r.history.last(token, p.Currency)
+			r.history.add(token, p.Currency, current[0], price, now)
+			tk := tick{price: price, previous: previous.price, hasPrevious: hasPrevious, at: now}
+
+			blocks := stored[cache.Token(token)][cache.Fiat(p.Currency)]
+			for _, block := range blocks {
+				if block.Quarantine != "" {
+					continue
+				}
+				ok, err := r.evaluate(block, tk)
 				if err != nil {
-					return err
+					r.failed(block, err)
+					continue
 				}
-
-				currentPrice := parsedFloats[0]
-				conditionPrice := parsedFloats[1]
-				if block.Condition == "==" && currentPrice == conditionPrice ||
-					block.Condition == ">" && currentPrice > conditionPrice ||
-					block.Condition == "<" && currentPrice < conditionPrice ||
-					block.Condition == ">=" && currentPrice >= conditionPrice ||
-					block.Condition == "<=" && currentPrice <= conditionPrice {
+				if ok {
 					block.CurrentPrice = price
 					requests = append(requests, block)
 				}
@@ -206,78 +271,76 @@ func (r *Receiver) schedule(pp []*parsedPrices) error {
 		return errors.New("no block to process")
 	}
 
-	var g errgroup.Group
+	// the outbox owns the notification from here on, so the condition
+	// is completed right away and doesn't fire again next tick
 	for _, block := range requests {
-		block := block
-		g.Go(func() error {
-			return r.checkStatusAccepted(block)
-		})
-	}
-	err := g.Wait()
-	if err != nil {
-		return err
+		if err := r.enqueue(block); err != nil {
+			log.Println(err)
+			continue
+		}
+		if err := r.complete(block); err != nil {
+			log.Println(err)
+		}
 	}
 	return nil
 }
 
-func parseFloat(f, s string) ([]float64, error) {
-	var floats []float64
-	first, err := strconv.ParseFloat(f, 64)
-	if err != nil {
-		return nil, err
-	}
-
-	second, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return nil, err
+// evaluate reports whether the block fires on the tick.
+func (r *Receiver) evaluate(block cache.ConditionBlock, tk tick) (bool, error) {
+	ok, err := r.armed(block, tk)
+	if err != nil || !ok {
+		return false, err
 	}
-
-	floats = append(floats, first, second)
-	return floats, nil
+	return r.triggered(block, tk)
 }
 
-func (r *Receiver) checkStatusAccepted(block cache.ConditionBlock) error {
-	var err error
-	ticker := time.NewTicker(time.Second * 3)
-
-	counter := 0
-	url := r.makeURL(block)
-	for ; counter < 4; <-ticker.C {
-		if err = checkURL(executedCondition(block), url); err != nil {
-			counter++
-			continue
+func parseDecimal(ss ...string) ([]*big.Rat, error) {
+	decimals := make([]*big.Rat, 0, len(ss))
+	for _, s := range ss {
+		// SetString also takes fractions and exponents, which could
+		// make a stored block allocate without bound
+		s = strings.TrimSpace(s)
+		if !t.ValidPrice(s) {
+			return nil, errors.Wrapf(errMalformed, "invalid decimal %q", s)
 		}
-
-		if err := r.store.Delete(block); err != nil {
-			return err
+		d, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, errors.Wrapf(errMalformed, "invalid decimal %q", s)
 		}
-		return nil
+		decimals = append(decimals, d)
 	}
-
-	return err
+	return decimals, nil
 }
 
-func (r *Receiver) makeURL(b cache.ConditionBlock) (url string) {
-	if strings.HasPrefix("http", b.URL) {
-		url = b.URL
-	} else {
-		url = r.botAlertURL
+// makeURL returns the webhook of the block, alerts of the bot go over
+// the broker and are marked with the event instead.
+func makeURL(b cache.ConditionBlock) string {
+	if isWebhook(b) {
+		return b.URL
 	}
-	return
+	return broker.Triggered
 }
 
-func checkURL(payload *t.TrueCondition, url string) error {
-	rq := req.New()
-	resp, err := rq.Post(url, req.BodyJSON(&payload))
-	if err != nil {
-		return errors.Wrap(err, "checkURL")
-	}
+func isWebhook(b cache.ConditionBlock) bool {
+	return strings.HasPrefix(b.URL, "http")
+}
 
-	if resp.Response().StatusCode != 202 {
-		return errors.Wrap(errors.New("response statusCode not 202"), "checkURL")
+// notify sends the executed condition of the block to its webhook or
+// publishes it for the bot.
+func (r *Receiver) notify(b cache.ConditionBlock, url string) (int, error) {
+	c := executedCondition(b)
+	if isWebhook(b) {
+		return r.webhooks.post(c, url)
 	}
 
-	return nil
+	body, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.broker.Publish(broker.Triggered, body); err != nil {
+		return 0, errors.Wrap(err, "publish triggered")
+	}
+	return 202, nil
 }
 
 func executedCondition(block cache.ConditionBlock) *t.TrueCondition {
@@ -296,6 +359,8 @@ func executedCondition(block cache.ConditionBlock) *t.TrueCondition {
 			Price:        block.Price,
 			CurrentPrice: block.CurrentPrice,
 		},
-		URL: block.URL,
+		ID:   block.ID,
+		Mode: block.Mode,
+		URL:  block.URL,
 	}
 }
@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	t "github.com/button-tech/utils-rate-alerts/types"
+)
+
+func newTestReceiver(tt *testing.T) (*Receiver, *FakeProvider, func()) {
+	dir, err := ioutil.TempDir("", "receiver")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	ob, err := openOutbox(filepath.Join(dir, "outbox"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	fp := NewFakeProvider()
+	b := broker.NewMemory(16)
+	r := &Receiver{
+		store:      cache.NewCache(),
+		history:    newHistory(),
+		prices:     fp,
+		outbox:     ob,
+		tombstones: newTombstones(),
+		members:    newMembers("test"),
+		listening:  make(chan struct{}),
+		mode:       modeShard,
+		lease:      &lease{},
+		broker:     b,
+	}
+	return r, fp, func() {
+		ob.close()
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newBlock(id, token, price, condition string) cache.ConditionBlock {
+	return cache.ConditionBlock{
+		ID:        id,
+		Currency:  token,
+		Fiat:      "USD",
+		Price:     price,
+		Condition: condition,
+		URL:       "https://example.com/hook",
+	}
+}
+
+func storeBlocks(tt *testing.T, r *Receiver, blocks ...cache.ConditionBlock) {
+	for _, b := range blocks {
+		if err := r.store.Set(b); err != nil {
+			tt.Fatal(err)
+		}
+	}
+}
+
+// notified returns the ids of the blocks waiting in the outbox.
+func notified(r *Receiver) map[string]bool {
+	ids := make(map[string]bool)
+	for _, n := range r.outbox.due(time.Now().Add(time.Hour)) {
+		ids[n.Block.ID] = true
+	}
+	return ids
+}
+
+func TestScheduleQuarantinesMalformedBlocks(tt *testing.T) {
+	r, fp, cleanup := newTestReceiver(tt)
+	defer cleanup()
+
+	badCooldown := newBlock("cooldown", "ETH", "100", ">")
+	badCooldown.Mode = t.ModeRecurring
+	badCooldown.Cooldown = "soon"
+	badCooldown.FiredAt = 1
+
+	badWindow := newBlock("window", "ETH", "10", percentUp)
+	badWindow.Window = "soon"
+
+	storeBlocks(tt, r,
+		newBlock("good", "ETH", "100", ">"),
+		newBlock("price", "ETH", "1/3", ">"),
+		badWindow,
+		badCooldown,
+	)
+	fp.Set("ETH", "USD", "150")
+
+	if err := r.getPrices([]string{"ETH"}, []string{"USD"}); err != nil {
+		tt.Fatal(err)
+	}
+
+	reasons := map[string]string{
+		"price":    "invalid decimal",
+		"window":   "invalid duration",
+		"cooldown": "invalid duration",
+	}
+	for id, reason := range reasons {
+		b, ok := r.store.Find(id)
+		if !ok {
+			tt.Fatalf("block %s is gone", id)
+		}
+		if !strings.Contains(b.Quarantine, reason) || b.QuarantinedAt == 0 {
+			tt.Errorf("block %s quarantine = %q, want a reason with %q", id, b.Quarantine, reason)
+		}
+	}
+
+	if ids := notified(r); !ids["good"] || len(ids) != 1 {
+		tt.Errorf("notified %v, want only good", ids)
+	}
+	if _, ok := r.store.Find("good"); ok {
+		tt.Error("one-shot block good is still stored after it fired")
+	}
+
+	// a quarantined block is skipped on the next pass
+	fp.Set("ETH", "USD", "160")
+	if err := r.getPrices([]string{"ETH"}, []string{"USD"}); err == nil {
+		tt.Error("second pass fired, want no block to process")
+	}
+	if got := len(r.quarantined()); got != len(reasons) {
+		tt.Errorf("%d blocks quarantined, want %d", got, len(reasons))
+	}
+}
+
+func TestScheduleSkipsBadProviderPrice(tt *testing.T) {
+	r, fp, cleanup := newTestReceiver(tt)
+	defer cleanup()
+
+	storeBlocks(tt, r,
+		newBlock("eth", "ETH", "100", ">"),
+		newBlock("btc", "BTC", "100", ">"),
+	)
+	fp.Set("ETH", "USD", "not a price")
+	fp.Set("BTC", "USD", "150")
+
+	if err := r.getPrices([]string{"ETH", "BTC"}, []string{"USD"}); err != nil {
+		tt.Fatal(err)
+	}
+
+	if ids := notified(r); !ids["btc"] || len(ids) != 1 {
+		tt.Errorf("notified %v, want only btc", ids)
+	}
+	b, ok := r.store.Find("eth")
+	if !ok {
+		tt.Fatal("block eth is gone")
+	}
+	if b.Quarantine != "" {
+		tt.Errorf("block eth quarantined for the price of the provider: %s", b.Quarantine)
+	}
+	if _, ok := r.history.last("ETH", "USD"); ok {
+		tt.Error("bad price of ETH was kept in the history")
+	}
+}
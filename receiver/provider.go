@@ -0,0 +1,215 @@
+package receiver
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/imroc/req"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastjson"
+)
+
+// Prices holds the rates of the tokens in one fiat currency.
+type Prices struct {
+	Currency string
+	Rates    map[string]string
+}
+
+type PriceProvider interface {
+	Name() string
+	Prices(tokens, currencies []string) ([]*Prices, error)
+}
+
+// Failover asks the providers in order and returns the first answer.
+type Failover []PriceProvider
+
+func (f Failover) Name() string {
+	names := make([]string, 0, len(f))
+	for _, p := range f {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (f Failover) Prices(tokens, currencies []string) ([]*Prices, error) {
+	failed := make([]string, 0, len(f))
+	for _, p := range f {
+		pp, err := p.Prices(tokens, currencies)
+		if err == nil {
+			return pp, nil
+		}
+		failed = append(failed, p.Name()+": "+err.Error())
+	}
+	return nil, errors.Errorf("all price providers failed: %s", strings.Join(failed, "; "))
+}
+
+const (
+	ratesProvider         = "rates"
+	cryptoCompareProvider = "cryptocompare"
+)
+
+// providers builds the failover from PRICE_PROVIDERS. Only our own
+// rates service is asked unless the operator lists cryptocompare, which
+// sends the subscribed tokens to a public third-party API.
+func providers(names string) (Failover, error) {
+	if names == "" {
+		names = ratesProvider
+	}
+
+	var f Failover
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case ratesProvider:
+			f = append(f, &ratesService{url: os.Getenv("PRICES"), api: crc})
+		case cryptoCompareProvider:
+			f = append(f, &cryptoCompare{url: cryptoCompareURL})
+		default:
+			return nil, errors.Errorf("unknown price provider %q", name)
+		}
+	}
+	return f, nil
+}
+
+const crc = "crc"
+
+// ratesService is our own rates aggregator.
+type ratesService struct {
+	url string
+	api string
+}
+
+func (rs *ratesService) Name() string {
+	return ratesProvider
+}
+
+func (rs *ratesService) Prices(tokens, currencies []string) ([]*Prices, error) {
+	b := t.RequestBlocks{
+		Tokens:     tokens,
+		Currencies: currencies,
+		API:        rs.api,
+	}
+	resp, err := req.Post(rs.url, req.BodyJSON(&b))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response().StatusCode != fasthttp.StatusOK {
+		return nil, errors.Wrap(errors.New("No http statusOK"), "responseStatusCode")
+	}
+
+	return respFastJSON(resp.Bytes())
+}
+
+const (
+	currency = "currency"
+	rates    = "rates"
+)
+
+func respFastJSON(b []byte) ([]*Prices, error) {
+	var p fastjson.Parser
+	parsed, err := p.ParseBytes(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseBytes")
+	}
+
+	var pp []*Prices
+
+	o := parsed.GetObject()
+	data := o.Get("data")
+	array, err := data.Array()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get array")
+	}
+	for _, v := range array {
+		obj, err := v.Object()
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get object")
+		}
+
+		var p Prices
+		m := make(map[string]string)
+		obj.Visit(func(key []byte, v *fastjson.Value) {
+			sKey := string(key)
+			if sKey == currency {
+				p.Currency = trim(v.String())
+			}
+
+			if sKey == rates {
+				rates, _ := v.Array()
+				for _, rate := range rates {
+					rateObj, _ := rate.Object()
+					rateObj.Visit(func(key []byte, v *fastjson.Value) {
+						m[string(key)] = trim(v.String())
+					})
+				}
+				p.Rates = m
+			}
+		})
+		pp = append(pp, &p)
+	}
+
+	return pp, nil
+}
+
+func trim(s string) string {
+	trimmed := strings.TrimPrefix(s, "\"")
+	trimmed = strings.TrimSuffix(trimmed, "\"")
+	return trimmed
+}
+
+const cryptoCompareURL = "https://min-api.cryptocompare.com/data/pricemulti"
+
+// cryptoCompare asks the public CryptoCompare API directly.
+type cryptoCompare struct {
+	url string
+}
+
+func (cc *cryptoCompare) Name() string {
+	return cryptoCompareProvider
+}
+
+func (cc *cryptoCompare) Prices(tokens, currencies []string) ([]*Prices, error) {
+	resp, err := req.Get(cc.url, req.QueryParam{
+		"fsyms": strings.Join(tokens, ","),
+		"tsyms": strings.Join(currencies, ","),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response().StatusCode != fasthttp.StatusOK {
+		return nil, errors.Wrap(errors.New("No http statusOK"), "responseStatusCode")
+	}
+
+	return parseCryptoCompare(resp.Bytes(), tokens, currencies)
+}
+
+// parseCryptoCompare turns {"BTC":{"USD":7000}} into Prices keyed
+// by the token and fiat spelling the subscribers used. The prices are
+// kept as the provider wrote them, a float64 would round them.
+func parseCryptoCompare(b []byte, tokens, currencies []string) ([]*Prices, error) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, errors.Wrap(err, "cryptocompare response")
+	}
+	if _, ok := body["Response"]; ok {
+		return nil, errors.New("cryptocompare: " + string(body["Message"]))
+	}
+
+	pp := make([]*Prices, 0, len(currencies))
+	for _, c := range currencies {
+		p := Prices{Currency: c, Rates: make(map[string]string)}
+		for _, tk := range tokens {
+			var rates map[string]json.Number
+			if err := json.Unmarshal(body[strings.ToUpper(tk)], &rates); err != nil {
+				continue
+			}
+			if rate, ok := rates[strings.ToUpper(c)]; ok {
+				p.Rates[tk] = rate.String()
+			}
+		}
+		pp = append(pp, &p)
+	}
+	return pp, nil
+}
@@ -0,0 +1,60 @@
+package receiver
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	"github.com/pkg/errors"
+)
+
+// errMalformed marks errors caused by the fields of a block, such a
+// block fails the same way on every tick.
+var errMalformed = errors.New("malformed subscription")
+
+// failed keeps one bad block from stopping the evaluation of the others:
+// a malformed one is quarantined, any other error is only logged and the
+// block is tried again next tick.
+func (r *Receiver) failed(block cache.ConditionBlock, err error) {
+	log.Printf("subscription %s: %s", block.ID, err)
+	if errors.Cause(err) != errMalformed {
+		return
+	}
+
+	block.Quarantine = err.Error()
+	block.QuarantinedAt = time.Now().Unix()
+	if err := r.save(block); err != nil {
+		log.Println(err)
+	}
+}
+
+// quarantined returns the quarantined blocks, the latest first.
+func (r *Receiver) quarantined() []cache.ConditionBlock {
+	var bb []cache.ConditionBlock
+	for _, fiats := range r.store.Get() {
+		for _, blocks := range fiats {
+			for _, b := range blocks {
+				if b.Quarantine != "" {
+					bb = append(bb, b)
+				}
+			}
+		}
+	}
+	sort.Slice(bb, func(i, j int) bool {
+		return bb[i].QuarantinedAt > bb[j].QuarantinedAt
+	})
+	return bb
+}
+
+// release puts the block back into evaluation, if it is still
+// malformed it is quarantined again on the next tick.
+func (r *Receiver) release(id string) (cache.ConditionBlock, error) {
+	b, ok := r.store.Find(id)
+	if !ok || b.Quarantine == "" {
+		return b, errors.New("not quarantined")
+	}
+	b.Quarantine = ""
+	b.QuarantinedAt = 0
+	return b, r.save(b)
+}
@@ -5,8 +5,11 @@ import (
 	"os"
 	"time"
 
+	"github.com/button-tech/utils-rate-alerts/pkg/broker"
+	"github.com/button-tech/utils-rate-alerts/pkg/env"
 	"github.com/button-tech/utils-rate-alerts/pkg/rabbitmq"
 	"github.com/button-tech/utils-rate-alerts/pkg/storage/cache"
+	"github.com/button-tech/utils-rate-alerts/pkg/storage/disk"
 	"github.com/pkg/errors"
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/valyala/fasthttp"
@@ -18,9 +21,21 @@ type Receiver struct {
 	g      *routing.RouteGroup
 	c      *controller
 
-	botAlertURL string
-	store       *cache.Cache
-	rabbitMQ    *rabbitmq.Instance
+	store       cache.Store
+	history     *history
+	prices      PriceProvider
+	deadLetters *deadLetters
+	outbox      *outbox
+	pool        *pool
+	webhooks    *webhooks
+	tombstones  *tombstones
+	members     *members
+	// closed once the changes queue is consumed, the others learn about
+	// this receiver only then, or their syncs could miss it
+	listening chan struct{}
+	mode      string
+	lease     *lease
+	broker    broker.Broker
 }
 
 func New() (*Receiver, error) {
@@ -28,13 +43,56 @@ func New() (*Receiver, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "rabbitMQ instance declaration")
 	}
+	return NewWithBroker(broker.NewAMQP(rabbitMQ))
+}
+
+// NewWithBroker builds the receiver on top of the given broker.
+func NewWithBroker(b broker.Broker) (*Receiver, error) {
+	mode := env.Or("RECEIVER_MODE", modeShard)
+	if mode != modeShard && mode != modeLeader {
+		return nil, errors.Errorf("unknown receiver mode %q, want %s or %s", mode, modeShard, modeLeader)
+	}
+
+	store, err := disk.Open(env.Or("STORE_PATH", "subscriptions.log"))
+	if err != nil {
+		return nil, errors.Wrap(err, "subscriptions store")
+	}
+
+	prices, err := providers(os.Getenv("PRICE_PROVIDERS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "price providers")
+	}
+
+	dl, err := openDeadLetters(env.Or("DEAD_LETTER_PATH", "dead-letters.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "dead letters")
+	}
+
+	ob, err := openOutbox(env.Or("OUTBOX_PATH", "outbox.log"))
+	if err != nil {
+		return nil, errors.Wrap(err, "outbox")
+	}
 
 	r := &Receiver{
-		store:       cache.NewCache(),
-		rabbitMQ:    rabbitMQ,
-		botAlertURL: os.Getenv("ALERT_BOT_URL"),
+		store:       store,
+		deadLetters: dl,
+		outbox:      ob,
+		history:     newHistory(),
+		members:     newMembers(broker.InstanceID()),
+		listening:   make(chan struct{}),
+		mode:        mode,
+		lease:       &lease{},
+		tombstones:  newTombstones(),
+		webhooks:    newWebhooks(os.Getenv("WEBHOOK_ALLOW_HOSTS")),
+		prices:      prices,
+		broker:      b,
 		r:           routing.New(),
 	}
+	r.pool = newPool(
+		env.Int("DELIVERY_WORKERS", defaultWorkers),
+		env.Int("DELIVERY_PER_HOST", defaultPerHost),
+		r.deliver,
+	)
 	r.r.Use(cors)
 	r.fs()
 	r.initRoute()
@@ -53,17 +111,23 @@ func (r *Receiver) fs() {
 
 func (r *Receiver) initRoute() {
 	r.g = r.r.Group("/api/processing")
-	r.c = &controller{store: r.store}
+	r.c = &controller{store: r.store, r: r}
 }
 
 func (r *Receiver) Finalize() {
-	log.Println("rabbitMQ channel close...")
-	if err := r.rabbitMQ.Channel.Close(); err != nil {
+	if err := r.announce(broker.Left); err != nil {
+		log.Println(err)
+	}
+	if err := r.broker.Close(); err != nil {
+		log.Println(err)
+	}
+
+	if err := r.outbox.close(); err != nil {
 		log.Println(err)
 	}
 
-	log.Println("rabbitMQ connection close...")
-	if err := r.rabbitMQ.Conn.Close(); err != nil {
+	log.Println("subscriptions store close...")
+	if err := r.store.Close(); err != nil {
 		log.Println(err)
 	}
 }
@@ -0,0 +1,49 @@
+package receiver
+
+import (
+	"sync"
+	"time"
+)
+
+// tombstoneTTL is how long a deletion waits for its subscription, as
+// long as a changes queue without consumers is kept.
+const tombstoneTTL = 24 * time.Hour
+
+type tombstone struct {
+	owner string
+	at    time.Time
+}
+
+// tombstones remember the deletions of subscriptions this receiver
+// doesn't have. Created alerts and changes travel on different queues,
+// so a deletion may come first, the subscription is dropped when it
+// arrives.
+type tombstones struct {
+	mu  sync.Mutex
+	ids map[string]tombstone
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{ids: make(map[string]tombstone)}
+}
+
+func (ts *tombstones) add(id, owner string, now time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for old, t := range ts.ids {
+		if now.Sub(t.at) > tombstoneTTL {
+			delete(ts.ids, old)
+		}
+	}
+	ts.ids[id] = tombstone{owner: owner, at: now}
+}
+
+// buried reports whether the subscription was deleted before it came.
+func (ts *tombstones) buried(id, owner string, now time.Time) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.ids[id]
+	return ok && t.owner == owner && now.Sub(t.at) <= tombstoneTTL
+}
@@ -0,0 +1,166 @@
+package receiver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	t "github.com/button-tech/utils-rate-alerts/types"
+	"github.com/imroc/req"
+	"github.com/pkg/errors"
+)
+
+// errForbiddenURL is returned for webhooks the receiver refuses to call,
+// retrying them can't help.
+var errForbiddenURL = errors.New("webhook url not allowed")
+
+// the addresses a webhook may not reach: loopback, private, shared,
+// link-local (cloud metadata lives there) and unspecified ones
+var internalNets = parseNets(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func internal(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooks posts the notifications. Only http(s) URLs are called and,
+// unless their host is listed in WEBHOOK_ALLOW_HOSTS, only on public
+// addresses: the address is checked again when the connection is made,
+// so a DNS answer that changes in between doesn't get through either.
+// Redirects are not followed.
+type webhooks struct {
+	allowed map[string]struct{}
+	public  *req.Req
+	trusted *req.Req
+}
+
+func newWebhooks(allowHosts string) *webhooks {
+	w := webhooks{
+		allowed: make(map[string]struct{}),
+		public:  req.New(),
+		trusted: req.New(),
+	}
+	for _, host := range strings.Split(allowHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			w.allowed[strings.ToLower(host)] = struct{}{}
+		}
+	}
+	w.public.SetClient(webhookClient(publicOnly))
+	w.trusted.SetClient(webhookClient(nil))
+	return &w
+}
+
+func webhookClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 2 * time.Minute,
+	}
+}
+
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internal(ip) {
+		return errors.Wrap(errForbiddenURL, host)
+	}
+	return nil
+}
+
+// client picks the client for rawURL, an error wrapping errForbiddenURL
+// means it may not be called at all.
+func (w *webhooks) client(rawURL string) (*req.Req, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(errForbiddenURL, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Wrapf(errForbiddenURL, "scheme %q", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return nil, errors.Wrap(errForbiddenURL, "no host")
+	}
+	if _, ok := w.allowed[host]; ok {
+		return w.trusted, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		// may pass, the address is checked again on connect
+		return w.public, nil
+	}
+	for _, ip := range ips {
+		if internal(ip.IP) {
+			return nil, errors.Wrapf(errForbiddenURL, "%s is internal", host)
+		}
+	}
+	return w.public, nil
+}
+
+func (w *webhooks) post(payload *t.TrueCondition, url string) (int, error) {
+	rq, err := w.client(url)
+	if err != nil {
+		return 0, errors.Wrap(err, "checkURL")
+	}
+	resp, err := rq.Post(url, req.BodyJSON(&payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "checkURL")
+	}
+
+	status := resp.Response().StatusCode
+	if status != 202 {
+		return status, errors.Wrap(errors.New("response statusCode not 202"), "checkURL")
+	}
+
+	return status, nil
+}
@@ -1,13 +1,51 @@
 package types
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
 type Payload map[string]interface{}
 
+const (
+	ModeOnce      = "once"
+	ModeRecurring = "recurring"
+
+	// the cooldown and the hysteresis of a recurring alert that sets
+	// none, without them it would fire on every price check
+	DefaultCooldown   = "1h"
+	DefaultHysteresis = "1"
+)
+
 type Alert struct {
-	Currency  string `json:"currency"`
-	Price     string `json:"price"`
-	Fiat      string `json:"fiat"`
-	Condition string `json:"condition"`
-	URL       string `json:"url"`
+	ID         string `json:"id"`
+	Currency   string `json:"currency"`
+	Price      string `json:"price"`
+	Fiat       string `json:"fiat"`
+	Condition  string `json:"condition"`
+	Tolerance  string `json:"tolerance,omitempty"`
+	Window     string `json:"window,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+	Cooldown   string `json:"cooldown,omitempty"`
+	Hysteresis string `json:"hysteresis,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	URL        string `json:"url"`
+}
+
+// WithDefaults fills the cooldown and the hysteresis a recurring alert
+// leaves empty. Percent conditions rebase instead of using a
+// hysteresis, so they get none.
+func (a Alert) WithDefaults() Alert {
+	if a.Mode != ModeRecurring {
+		return a
+	}
+	if a.Cooldown == "" {
+		a.Cooldown = DefaultCooldown
+	}
+	if a.Hysteresis == "" && !PercentCondition(a.Condition) {
+		a.Hysteresis = DefaultHysteresis
+	}
+	return a
 }
 
 type TrueCondition struct {
@@ -19,7 +57,9 @@ type TrueCondition struct {
 		Price        string `json:"price"`
 		CurrentPrice string `json:"currentPrice"`
 	} `json:"values"`
-	URL string `json:"url"`
+	ID   string `json:"id"`
+	Mode string `json:"mode,omitempty"`
+	URL  string `json:"url"`
 }
 
 type RequestBlocks struct {
@@ -27,3 +67,11 @@ type RequestBlocks struct {
 	Currencies []string `json:"currencies"`
 	API        string   `json:"api"`
 }
+
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
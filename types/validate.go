@@ -0,0 +1,147 @@
+package types
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tokens and Fiats are the currencies the price providers know.
+var Tokens = map[string]struct{}{"ADA": {}, "AE": {}, "ALGO": {}, "ARDR": {}, "ATOM": {}, "BCD": {}, "BCH": {}, "BCN": {}, "BNB": {}, "BSV": {}, "BTC": {}, "BTG": {}, "BTM": {}, "BTS": {}, "BTT": {}, "CENNZ": {}, "DASH": {}, "DCR": {}, "DGB": {}, "DOGE": {}, "EOS": {}, "ETC": {}, "ETH": {}, "ICX": {}, "IOST": {}, "KMD": {}, "LSK": {}, "LTC": {}, "LUNA": {}, "MONA": {}, "NANO": {}, "NEO": {}, "NRG": {}, "ONT": {}, "QTUM": {}, "RVN": {}, "STEEM": {}, "STRAT": {}, "THETA": {}, "TOMO": {}, "TRX": {}, "VET": {}, "VSYS": {}, "WAVES": {}, "XEM": {}, "XLM": {}, "XMR": {}, "XRP": {}, "XTZ": {}, "XVG": {}, "ZEC": {}, "ZEN": {}, "ZIL": {}}
+var Fiats = map[string]struct{}{"AED": {}, "ALL": {}, "AMD": {}, "AOA": {}, "ARS": {}, "AUD": {}, "BAM": {}, "BDT": {}, "BGN": {}, "BHD": {}, "BIF": {}, "BND": {}, "BOB": {}, "BRL": {}, "BSD": {}, "BTC": {}, "BTN": {}, "BWP": {}, "BYN": {}, "CAD": {}, "CDF": {}, "CHF": {}, "CLP": {}, "CNY": {}, "COP": {}, "CRC": {}, "CZK": {}, "DKK": {}, "DOP": {}, "DZD": {}, "EGP": {}, "ETB": {}, "EUR": {}, "GBP": {}, "GEL": {}, "GGP": {}, "GHS": {}, "GIP": {}, "GTQ": {}, "HKD": {}, "HNL": {}, "HRK": {}, "HUF": {}, "IDR": {}, "ILS": {}, "INR": {}, "IQD": {}, "IRR": {}, "ISK": {}, "JMD": {}, "JOD": {}, "JPY": {}, "KES": {}, "KGS": {}, "KHR": {}, "KRW": {}, "KWD": {}, "KZT": {}, "LBP": {}, "LKR": {}, "LSL": {}, "MAD": {}, "MDL": {}, "MMK": {}, "MOP": {}, "MUR": {}, "MWK": {}, "MXN": {}, "MYR": {}, "NAD": {}, "NGN": {}, "NIO": {}, "NOK": {}, "NPR": {}, "NZD": {}, "OMR": {}, "PAB": {}, "PEN": {}, "PGK": {}, "PHP": {}, "PKR": {}, "PLN": {}, "PYG": {}, "QAR": {}, "RON": {}, "RUB": {}, "RWF": {}, "SAR": {}, "SBD": {}, "SEK": {}, "SGD": {}, "SHP": {}, "SZL": {}, "THB": {}, "TMT": {}, "TND": {}, "TOP": {}, "TRY": {}, "TTD": {}, "TWD": {}, "TZS": {}, "UAH": {}, "UGX": {}, "USD": {}, "UYU": {}, "UZS": {}, "VEF": {}, "VND": {}, "VUV": {}, "XAF": {}, "XAU": {}, "XCD": {}, "XOF": {}, "ZAR": {}, "ZMW": {}}
+
+var Conditions = map[string]struct{}{
+	">":  {},
+	"<":  {},
+	"==": {},
+	">=": {},
+	"<=": {},
+	"~=": {},
+	"+%": {},
+	"-%": {},
+	"±%": {},
+
+	"crosses_above": {},
+	"crosses_below": {},
+}
+
+var (
+	decimal = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	// the bot sends its alerts to "<chat id>_<language>"
+	chatURL = regexp.MustCompile(`^-?[0-9]+_(english|russian)$`)
+)
+
+// FieldError tells what is wrong with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	ss := make([]string, 0, len(e))
+	for _, f := range e {
+		ss = append(ss, f.Field+": "+f.Message)
+	}
+	return "invalid alert: " + strings.Join(ss, ", ")
+}
+
+func ValidToken(s string) bool {
+	_, ok := Tokens[strings.ToUpper(s)]
+	return ok
+}
+
+func ValidFiat(s string) bool {
+	_, ok := Fiats[strings.ToUpper(s)]
+	return ok
+}
+
+// ValidPrice accepts plain non-negative decimals, the form the
+// receiver compares exactly.
+func ValidPrice(s string) bool {
+	return decimal.MatchString(s)
+}
+
+func ValidCondition(s string) bool {
+	_, ok := Conditions[s]
+	return ok
+}
+
+// PercentCondition reports whether the condition is a change by a
+// percent, which the receiver measures from a base price.
+func PercentCondition(s string) bool {
+	return s == "+%" || s == "-%" || s == "±%"
+}
+
+// ValidURL accepts an http(s) webhook or a chat of the bot.
+func ValidURL(s string) bool {
+	if chatURL.MatchString(s) {
+		return true
+	}
+	u, err := url.ParseRequestURI(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Validate checks a new alert, the returned error is a ValidationError.
+func (a Alert) Validate() error {
+	return a.validate(false)
+}
+
+// ValidatePatch checks only the fields set in a partial update.
+func (a Alert) ValidatePatch() error {
+	return a.validate(true)
+}
+
+func (a Alert) validate(partial bool) error {
+	var errs ValidationError
+	check := func(field, value string, ok func(string) bool, message string) {
+		if value == "" {
+			if !partial {
+				errs = append(errs, FieldError{Field: field, Message: "is required"})
+			}
+			return
+		}
+		if !ok(value) {
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+	}
+	optional := func(field, value string, ok func(string) bool, message string) {
+		if value != "" && !ok(value) {
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+	}
+
+	check("currency", a.Currency, ValidToken, "unknown token")
+	check("fiat", a.Fiat, ValidFiat, "unknown fiat")
+	check("price", a.Price, ValidPrice, "must be a non-negative decimal")
+	check("condition", a.Condition, ValidCondition, "unknown condition")
+	check("url", a.URL, ValidURL, "must be an http(s) URL")
+	optional("tolerance", a.Tolerance, ValidPrice, "must be a non-negative decimal")
+	optional("hysteresis", a.Hysteresis, ValidPrice, "must be a non-negative decimal")
+	optional("window", a.Window, validDuration, "must be a duration like 1h")
+	optional("cooldown", a.Cooldown, validDuration, "must be a duration like 1h")
+	optional("mode", a.Mode, validMode, "must be once or recurring")
+	if a.Hysteresis != "" && PercentCondition(a.Condition) {
+		errs = append(errs, FieldError{Field: "hysteresis", Message: "is not used by percent conditions"})
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validDuration(s string) bool {
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
+
+func validMode(s string) bool {
+	return s == ModeOnce || s == ModeRecurring
+}